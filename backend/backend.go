@@ -0,0 +1,146 @@
+// Package backend defines the hypervisor operations gokvm relies on.
+// The libvirt implementation lives in package qemu, an in-memory one in
+// package fake.
+package backend
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned (possibly wrapped) when a lookup does not match
+// any domain, network, storage pool or volume.
+var ErrNotFound = errors.New("not found")
+
+type Backend interface {
+	Close() error
+	// URI returns the connection URI, it tells the hosts apart in the
+	// local stores of gokvm.
+	URI() (string, error)
+
+	// Capabilities returns the host capabilities XML.
+	Capabilities() (string, error)
+	// DomainCapabilities returns the domain capabilities XML for the
+	// given emulator, architecture, machine type and virtualization type.
+	DomainCapabilities(emulator, arch, machine, virtType string) (string, error)
+
+	ListDomains() ([]Domain, error)
+	LookupDomain(name string) (Domain, error)
+	DefineDomain(xml string) (Domain, error)
+
+	ListNetworks() ([]Network, error)
+	LookupNetwork(name string) (Network, error)
+	DefineNetwork(xml string) (Network, error)
+
+	LookupStoragePool(name string) (StoragePool, error)
+	DefineStoragePool(xml string) (StoragePool, error)
+}
+
+// Recorder is implemented by backends that only record the changes gokvm
+// would make instead of applying them, see package dryrun. Callers skip
+// expensive work like image downloads and report generated content that
+// never reaches the backend as XML.
+type Recorder interface {
+	Record(kind, name, content string)
+}
+
+type Domain interface {
+	Name() (string, error)
+	XML() (string, error)
+	IsActive() (bool, error)
+	State() (DomainState, error)
+	Create() error
+	// Shutdown asks the guest to power off and returns without waiting.
+	Shutdown() error
+	Destroy() error
+	Reboot() error
+	Suspend() error
+	Resume() error
+	Undefine() error
+	SetAutostart(autostart bool) error
+	InterfaceAddresses(source AddressSource) ([]Interface, error)
+	// AgentCommand sends a JSON command to the QEMU guest agent and
+	// returns the JSON reply.
+	AgentCommand(command string, timeout time.Duration) (string, error)
+	CreateSnapshot(xml string) (Snapshot, error)
+	ListSnapshots() ([]Snapshot, error)
+	LookupSnapshot(name string) (Snapshot, error)
+	// OpenConsole connects to the first serial console of the running
+	// domain. With force an existing console session is disconnected.
+	OpenConsole(force bool) (io.ReadWriteCloser, error)
+}
+
+type Snapshot interface {
+	Name() (string, error)
+	XML() (string, error)
+	// Revert reverts the domain to the snapshot. With running the domain
+	// runs afterwards, whatever state the snapshot was taken in.
+	Revert(running bool) error
+	Delete() error
+}
+
+type DomainState string
+
+const (
+	DomainNoState     DomainState = "nostate"
+	DomainRunning     DomainState = "running"
+	DomainBlocked     DomainState = "blocked"
+	DomainPaused      DomainState = "paused"
+	DomainShutdown    DomainState = "shutdown"
+	DomainShutoff     DomainState = "shutoff"
+	DomainCrashed     DomainState = "crashed"
+	DomainPMSuspended DomainState = "pmsuspended"
+)
+
+// AddressSource selects where InterfaceAddresses takes the addresses from.
+type AddressSource string
+
+const (
+	// AddressesFromLease reports the DHCP leases of libvirt networks.
+	AddressesFromLease AddressSource = "lease"
+	// AddressesFromAgent asks the guest agent, which also knows static
+	// addresses and addresses on networks without libvirt DHCP.
+	AddressesFromAgent AddressSource = "agent"
+)
+
+// Interface is a guest network interface together with the addresses
+// the hypervisor knows for it.
+type Interface struct {
+	Name   string
+	Hwaddr string
+	Addrs  []string
+}
+
+type Network interface {
+	Name() (string, error)
+	XML() (string, error)
+	IsActive() (bool, error)
+	Create() error
+	Destroy() error
+	Undefine() error
+	SetAutostart(autostart bool) error
+	// AddDHCPHost adds a <host mac= ip= name=/> reservation to the DHCP
+	// configuration of the network, DeleteDHCPHost removes it.
+	AddDHCPHost(xml string) error
+	DeleteDHCPHost(xml string) error
+}
+
+type StoragePool interface {
+	XML() (string, error)
+	// Create builds the pool target if needed and starts the pool.
+	Create() error
+	Destroy() error
+	Undefine() error
+	SetAutostart(autostart bool) error
+	ListVolumes() ([]StorageVolume, error)
+	LookupVolume(name string) (StorageVolume, error)
+	CreateVolume(xml string) (StorageVolume, error)
+}
+
+type StorageVolume interface {
+	XML() (string, error)
+	Delete() error
+	// Upload replaces the volume content with size bytes read from r.
+	Upload(r io.Reader, size uint64) error
+}
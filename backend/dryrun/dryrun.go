@@ -0,0 +1,420 @@
+// Package dryrun provides a backend that reads from another backend but
+// only prints the changes gokvm would make. Objects defined during the dry
+// run are kept in an in-memory fake so that later lookups find them.
+package dryrun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/backend/fake"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+type Backend struct {
+	real   backend.Backend
+	shadow *fake.Backend
+	out    io.Writer
+
+	mu sync.Mutex
+	// mirrored holds the existing pools copied into shadow to take the
+	// volumes created in them.
+	mirrored map[string]bool
+}
+
+var _ backend.Recorder = &Backend{}
+
+// New returns a backend printing all changes to out. Lookups are answered
+// by real, which is never modified.
+func New(real backend.Backend, out io.Writer) *Backend {
+	return &Backend{
+		real:     real,
+		shadow:   fake.New(),
+		out:      out,
+		mirrored: make(map[string]bool),
+	}
+}
+
+// Record prints content generated for name, e.g. cloud-init user-data.
+func (b *Backend) Record(kind, name, content string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(b.out, "# %s %s\n%s\n", kind, name, strings.TrimRight(content, "\n"))
+}
+
+// note prints an operation that is skipped on an existing object.
+func (b *Backend) note(format string, args ...interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(b.out, "# "+format+"\n", args...)
+	return nil
+}
+
+func (b *Backend) Close() error {
+	return b.real.Close()
+}
+
+func (b *Backend) URI() (string, error) {
+	return b.real.URI()
+}
+
+func (b *Backend) Capabilities() (string, error) {
+	return b.real.Capabilities()
+}
+
+func (b *Backend) DomainCapabilities(emulator, arch, machine, virtType string) (string, error) {
+	return b.real.DomainCapabilities(emulator, arch, machine, virtType)
+}
+
+func (b *Backend) ListDomains() ([]backend.Domain, error) {
+	domains, err := b.shadow.ListDomains()
+	if err != nil {
+		return nil, err
+	}
+	realDomains, err := b.real.ListDomains()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range realDomains {
+		domains = append(domains, &domain{Domain: d, b: b})
+	}
+	return domains, nil
+}
+
+func (b *Backend) LookupDomain(name string) (backend.Domain, error) {
+	d, err := b.shadow.LookupDomain(name)
+	if err == nil {
+		return d, nil
+	}
+	realDomain, err := b.real.LookupDomain(name)
+	if err != nil {
+		return nil, err
+	}
+	return &domain{Domain: realDomain, b: b}, nil
+}
+
+func (b *Backend) DefineDomain(xml string) (backend.Domain, error) {
+	d, err := b.shadow.DefineDomain(xml)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := d.Name()
+	b.Record("domain", name, xml)
+	return d, nil
+}
+
+func (b *Backend) ListNetworks() ([]backend.Network, error) {
+	networks, err := b.shadow.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	realNetworks, err := b.real.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range realNetworks {
+		networks = append(networks, &network{Network: n, b: b})
+	}
+	return networks, nil
+}
+
+func (b *Backend) LookupNetwork(name string) (backend.Network, error) {
+	n, err := b.shadow.LookupNetwork(name)
+	if err == nil {
+		return n, nil
+	}
+	realNetwork, err := b.real.LookupNetwork(name)
+	if err != nil {
+		return nil, err
+	}
+	return &network{Network: realNetwork, b: b}, nil
+}
+
+func (b *Backend) DefineNetwork(xml string) (backend.Network, error) {
+	n, err := b.shadow.DefineNetwork(xml)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := n.Name()
+	b.Record("network", name, xml)
+	return n, nil
+}
+
+func (b *Backend) LookupStoragePool(name string) (backend.StoragePool, error) {
+	b.mu.Lock()
+	mirrored := b.mirrored[name]
+	b.mu.Unlock()
+	if !mirrored {
+		p, err := b.shadow.LookupStoragePool(name)
+		if err == nil {
+			return &storagePool{b: b, name: name, shadow: p}, nil
+		}
+	}
+	realPool, err := b.real.LookupStoragePool(name)
+	if err != nil {
+		return nil, err
+	}
+	return &storagePool{b: b, name: name, real: realPool}, nil
+}
+
+func (b *Backend) DefineStoragePool(xml string) (backend.StoragePool, error) {
+	var xmlPool libvirtxml.StoragePool
+	if err := xmlPool.Unmarshal(xml); err != nil {
+		return nil, err
+	}
+	p, err := b.shadow.DefineStoragePool(xml)
+	if err != nil {
+		return nil, err
+	}
+	b.Record("storage pool", xmlPool.Name, xml)
+	return &storagePool{b: b, name: xmlPool.Name, shadow: p}, nil
+}
+
+// domain is an existing domain, all changes are only printed.
+type domain struct {
+	backend.Domain
+	b *Backend
+}
+
+func (d *domain) note(op string) error {
+	name, _ := d.Name()
+	return d.b.note("%s domain %s", op, name)
+}
+
+func (d *domain) Create() error   { return d.note("start") }
+func (d *domain) Shutdown() error { return d.note("shutdown") }
+func (d *domain) Destroy() error  { return d.note("destroy") }
+func (d *domain) Reboot() error   { return d.note("reboot") }
+func (d *domain) Suspend() error  { return d.note("suspend") }
+func (d *domain) Resume() error   { return d.note("resume") }
+func (d *domain) Undefine() error { return d.note("undefine") }
+
+func (d *domain) SetAutostart(autostart bool) error {
+	return d.note(fmt.Sprintf("set autostart %t on", autostart))
+}
+
+func (d *domain) CreateSnapshot(xml string) (backend.Snapshot, error) {
+	name, _ := d.Name()
+	return nil, fmt.Errorf("dry run: cannot snapshot domain %s", name)
+}
+
+func (d *domain) ListSnapshots() ([]backend.Snapshot, error) {
+	snaps, err := d.Domain.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []backend.Snapshot
+	for _, snap := range snaps {
+		snapshots = append(snapshots, &snapshot{Snapshot: snap, d: d})
+	}
+	return snapshots, nil
+}
+
+func (d *domain) LookupSnapshot(name string) (backend.Snapshot, error) {
+	snap, err := d.Domain.LookupSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{Snapshot: snap, d: d}, nil
+}
+
+// snapshot is an existing snapshot, all changes are only printed.
+type snapshot struct {
+	backend.Snapshot
+	d *domain
+}
+
+func (s *snapshot) note(op string) error {
+	name, _ := s.Name()
+	return s.d.note(fmt.Sprintf("%s snapshot %s of", op, name))
+}
+
+func (s *snapshot) Revert(running bool) error { return s.note("revert to") }
+func (s *snapshot) Delete() error             { return s.note("delete") }
+
+// network is an existing network, all changes are only printed.
+type network struct {
+	backend.Network
+	b *Backend
+}
+
+func (n *network) note(op string) error {
+	name, _ := n.Name()
+	return n.b.note("%s network %s", op, name)
+}
+
+func (n *network) Create() error   { return n.note("start") }
+func (n *network) Destroy() error  { return n.note("destroy") }
+func (n *network) Undefine() error { return n.note("undefine") }
+
+func (n *network) SetAutostart(autostart bool) error {
+	return n.note(fmt.Sprintf("set autostart %t on", autostart))
+}
+
+func (n *network) AddDHCPHost(xml string) error {
+	return n.note("add dhcp host " + xml + " to")
+}
+
+func (n *network) DeleteDHCPHost(xml string) error {
+	return n.note("delete dhcp host " + xml + " from")
+}
+
+// storagePool is either an existing pool (real set) or one defined during
+// the dry run (shadow set). Volumes created in an existing pool go to a
+// copy of it in the fake backend.
+type storagePool struct {
+	b      *Backend
+	name   string
+	real   backend.StoragePool
+	shadow backend.StoragePool
+}
+
+func (p *storagePool) XML() (string, error) {
+	if p.real != nil {
+		return p.real.XML()
+	}
+	return p.shadow.XML()
+}
+
+func (p *storagePool) note(op string) error {
+	return p.b.note("%s storage pool %s", op, p.name)
+}
+
+func (p *storagePool) Create() error {
+	if p.real != nil {
+		return p.note("start")
+	}
+	return p.shadow.Create()
+}
+
+func (p *storagePool) Destroy() error {
+	if p.real != nil {
+		return p.note("destroy")
+	}
+	return p.shadow.Destroy()
+}
+
+func (p *storagePool) Undefine() error {
+	if p.real != nil {
+		return p.note("undefine")
+	}
+	return p.shadow.Undefine()
+}
+
+func (p *storagePool) SetAutostart(autostart bool) error {
+	if p.real != nil {
+		return p.note(fmt.Sprintf("set autostart %t on", autostart))
+	}
+	return p.shadow.SetAutostart(autostart)
+}
+
+// mirror returns the shadow pool taking the volumes created in the dry
+// run, copying an existing pool into the fake backend on first use.
+func (p *storagePool) mirror() (backend.StoragePool, error) {
+	if p.shadow != nil {
+		return p.shadow, nil
+	}
+	p.b.mu.Lock()
+	mirrored := p.b.mirrored[p.name]
+	p.b.mu.Unlock()
+	if !mirrored {
+		poolXML, err := p.real.XML()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.b.shadow.DefineStoragePool(poolXML); err != nil {
+			return nil, err
+		}
+		p.b.mu.Lock()
+		p.b.mirrored[p.name] = true
+		p.b.mu.Unlock()
+	}
+	shadow, err := p.b.shadow.LookupStoragePool(p.name)
+	if err != nil {
+		return nil, err
+	}
+	p.shadow = shadow
+	return shadow, nil
+}
+
+func (p *storagePool) ListVolumes() ([]backend.StorageVolume, error) {
+	var vols []backend.StorageVolume
+	if p.shadow != nil || p.isMirrored() {
+		shadow, err := p.mirror()
+		if err != nil {
+			return nil, err
+		}
+		if vols, err = shadow.ListVolumes(); err != nil {
+			return nil, err
+		}
+	}
+	if p.real != nil {
+		realVols, err := p.real.ListVolumes()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range realVols {
+			vols = append(vols, &storageVolume{StorageVolume: v, b: p.b})
+		}
+	}
+	return vols, nil
+}
+
+func (p *storagePool) LookupVolume(name string) (backend.StorageVolume, error) {
+	if p.shadow != nil || p.isMirrored() {
+		shadow, err := p.mirror()
+		if err != nil {
+			return nil, err
+		}
+		v, err := shadow.LookupVolume(name)
+		if err == nil || p.real == nil {
+			return v, err
+		}
+		if !errors.Is(err, backend.ErrNotFound) {
+			return nil, err
+		}
+	}
+	v, err := p.real.LookupVolume(name)
+	if err != nil {
+		return nil, err
+	}
+	return &storageVolume{StorageVolume: v, b: p.b}, nil
+}
+
+func (p *storagePool) CreateVolume(xml string) (backend.StorageVolume, error) {
+	shadow, err := p.mirror()
+	if err != nil {
+		return nil, err
+	}
+	v, err := shadow.CreateVolume(xml)
+	if err != nil {
+		return nil, err
+	}
+	p.b.Record("storage volume", "in pool "+p.name, xml)
+	return v, nil
+}
+
+func (p *storagePool) isMirrored() bool {
+	p.b.mu.Lock()
+	defer p.b.mu.Unlock()
+	return p.b.mirrored[p.name]
+}
+
+// storageVolume is an existing volume, all changes are only printed.
+type storageVolume struct {
+	backend.StorageVolume
+	b *Backend
+}
+
+func (v *storageVolume) Delete() error {
+	return v.b.note("delete storage volume")
+}
+
+func (v *storageVolume) Upload(r io.Reader, size uint64) error {
+	return v.b.note("upload %d bytes to storage volume", size)
+}
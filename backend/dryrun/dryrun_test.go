@@ -0,0 +1,249 @@
+package dryrun
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/backend/fake"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+// newReal returns a fake backend with the running domain vm and its
+// snapshot snap, the active network net and the pool pool holding the
+// volume base.
+func newReal(t *testing.T) *fake.Backend {
+	t.Helper()
+	real := fake.New()
+	d, err := real.DefineDomain("<domain><name>vm</name></domain>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateSnapshot("<domainsnapshot><name>snap</name></domainsnapshot>"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := real.DefineNetwork(`<network><name>net</name><ip address="192.168.1.1" netmask="255.255.255.0"><dhcp/></ip></network>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Create(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := real.DefineStoragePool(`<pool type="dir"><name>pool</name><target><path>/pool</path></target></pool>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateVolume(volumeXML("base")); err != nil {
+		t.Fatal(err)
+	}
+	return real
+}
+
+func volumeXML(name string) string {
+	return "<volume><name>" + name + "</name><capacity>1024</capacity></volume>"
+}
+
+// volumeNames returns the names of the volumes in pool as seen by l.
+func volumeNames(t *testing.T, l backend.Backend, pool string) []string {
+	t.Helper()
+	p, err := l.LookupStoragePool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vols, err := p.ListVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, vol := range vols {
+		volXML, err := vol.XML()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var xmlVol libvirtxml.StorageVolume
+		if err := xmlVol.Unmarshal(volXML); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, xmlVol.Name)
+	}
+	return names
+}
+
+func TestExistingObjectsUnchanged(t *testing.T) {
+	real := newReal(t)
+	var out bytes.Buffer
+	l := New(real, &out)
+
+	d, err := l.LookupDomain("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := d.LookupSnapshot("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := l.LookupNetwork("net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := l.LookupStoragePool("pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := p.LookupVolume("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []struct {
+		name string
+		op   func() error
+		note string
+	}{
+		{"suspend domain", d.Suspend, "# suspend domain vm"},
+		{"shutdown domain", d.Shutdown, "# shutdown domain vm"},
+		{"destroy domain", d.Destroy, "# destroy domain vm"},
+		{"revert snapshot", func() error { return snap.Revert(false) }, "# revert to snapshot snap of domain vm"},
+		{"delete snapshot", snap.Delete, "# delete snapshot snap of domain vm"},
+		{"undefine domain", d.Undefine, "# undefine domain vm"},
+		{"add dhcp host", func() error { return n.AddDHCPHost(`<host mac="52:54:00:00:00:01" ip="192.168.1.2"/>`) }, "# add dhcp host"},
+		{"destroy network", n.Destroy, "# destroy network net"},
+		{"undefine network", n.Undefine, "# undefine network net"},
+		{"upload volume", func() error { return vol.Upload(strings.NewReader("data"), 4) }, "# upload 4 bytes to storage volume"},
+		{"delete volume", vol.Delete, "# delete storage volume"},
+		{"destroy pool", p.Destroy, "# destroy storage pool pool"},
+		{"undefine pool", p.Undefine, "# undefine storage pool pool"},
+	}
+	for _, tt := range ops {
+		out.Reset()
+		if err := tt.op(); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !strings.HasPrefix(out.String(), tt.note) {
+			t.Errorf("%s: printed %q, want %q", tt.name, out.String(), tt.note)
+		}
+	}
+
+	realDomain, err := real.LookupDomain("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := realDomain.State(); err != nil || state != backend.DomainRunning {
+		t.Errorf("domain vm is %s, want running", state)
+	}
+	if _, err := realDomain.LookupSnapshot("snap"); err != nil {
+		t.Errorf("snapshot snap: %s", err)
+	}
+	realNetwork, err := real.LookupNetwork("net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, err := realNetwork.IsActive(); err != nil || !active {
+		t.Error("network net is no longer active")
+	}
+	if xml, _ := realNetwork.XML(); strings.Contains(xml, "52:54:00:00:00:01") {
+		t.Error("dhcp host was added to network net")
+	}
+	realPool, err := real.LookupStoragePool("pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	realVol, err := realPool.LookupVolume("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := realVol.(*fake.StorageVolume).Data(); data != nil {
+		t.Errorf("volume base has data %q, want none", data)
+	}
+}
+
+func TestDefinedObjectsShadowed(t *testing.T) {
+	real := newReal(t)
+	var out bytes.Buffer
+	l := New(real, &out)
+
+	if _, err := l.DefineDomain("<domain><name>new</name></domain>"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "# domain new\n<domain><name>new</name></domain>") {
+		t.Errorf("got output %q, want the domain XML", out.String())
+	}
+	domains, err := l.ListDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 {
+		t.Errorf("got %d domains, want vm and new", len(domains))
+	}
+	if _, err := real.LookupDomain("new"); err == nil {
+		t.Error("domain new was defined in the real backend")
+	}
+
+	if _, err := l.DefineStoragePool(`<pool type="dir"><name>other</name><target><path>/other</path></target></pool>`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := real.LookupStoragePool("other"); err == nil {
+		t.Error("pool other was defined in the real backend")
+	}
+}
+
+func TestMirroredPool(t *testing.T) {
+	real := newReal(t)
+	var out bytes.Buffer
+	l := New(real, &out)
+
+	p, err := l.LookupStoragePool("pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.CreateVolume(volumeXML("overlay")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "# storage volume in pool pool\n") {
+		t.Errorf("got output %q, want the volume XML", out.String())
+	}
+
+	// a new lookup of the pool finds the volumes of both backends
+	if got := volumeNames(t, l, "pool"); strings.Join(got, " ") != "overlay base" {
+		t.Errorf("got volumes %v, want overlay and base", got)
+	}
+	p, err = l.LookupStoragePool("pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"overlay", "base"} {
+		if _, err := p.LookupVolume(name); err != nil {
+			t.Errorf("volume %s: %s", name, err)
+		}
+	}
+	if _, err := p.LookupVolume("missing"); err == nil {
+		t.Error("found the missing volume")
+	}
+	if _, err := p.CreateVolume(volumeXML("overlay")); err == nil {
+		t.Error("creating volume overlay twice succeeded")
+	}
+	// the real pool still only holds base and its definition is kept
+	if got := volumeNames(t, real, "pool"); strings.Join(got, " ") != "base" {
+		t.Errorf("got real volumes %v, want only base", got)
+	}
+	poolXML, err := p.XML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(poolXML, "<path>/pool</path>") {
+		t.Errorf("got pool XML %s, want the path of the real pool", poolXML)
+	}
+	if err := p.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := real.LookupStoragePool("pool"); err != nil {
+		t.Errorf("real pool: %s", err)
+	}
+}
@@ -0,0 +1,711 @@
+// Package fake is an in-memory backend.Backend for exercising gokvm
+// without a libvirt daemon.
+package fake
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+type Backend struct {
+	mu             sync.Mutex
+	domains        map[string]*Domain
+	networks       map[string]*Network
+	pools          map[string]*StoragePool
+	addresses      map[string][]backend.Interface
+	agents         map[string]AgentHandler
+	agentAddresses map[string][]backend.Interface
+}
+
+// AgentHandler answers guest agent commands of a domain.
+type AgentHandler func(command string) (string, error)
+
+func New() *Backend {
+	return &Backend{
+		domains:        make(map[string]*Domain),
+		networks:       make(map[string]*Network),
+		pools:          make(map[string]*StoragePool),
+		addresses:      make(map[string][]backend.Interface),
+		agents:         make(map[string]AgentHandler),
+		agentAddresses: make(map[string][]backend.Interface),
+	}
+}
+
+// SetInterfaceAddresses sets what InterfaceAddresses reports from DHCP
+// leases for the domain called name.
+func (b *Backend) SetInterfaceAddresses(name string, interfaces []backend.Interface) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addresses[name] = interfaces
+}
+
+// SetAgent connects a guest agent to the domain called name, interfaces
+// is what InterfaceAddresses reports from the agent.
+func (b *Backend) SetAgent(name string, handler AgentHandler, interfaces []backend.Interface) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.agents[name] = handler
+	b.agentAddresses[name] = interfaces
+}
+
+func (b *Backend) Close() error {
+	return nil
+}
+
+// URI is the connection URI of all fake backends.
+const URI = "test:///default"
+
+func (b *Backend) URI() (string, error) {
+	return URI, nil
+}
+
+// Capabilities describes an x86_64 KVM host.
+func (b *Backend) Capabilities() (string, error) {
+	return capabilities, nil
+}
+
+// DomainCapabilities reports host-model and host-passthrough CPUs as
+// supported.
+func (b *Backend) DomainCapabilities(emulator, arch, machine, virtType string) (string, error) {
+	return fmt.Sprintf(domainCapabilities, emulator, virtType, machine, arch), nil
+}
+
+func (b *Backend) ListDomains() ([]backend.Domain, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var domains []backend.Domain
+	for _, name := range sortedKeys(b.domains) {
+		domains = append(domains, b.domains[name])
+	}
+	return domains, nil
+}
+
+func (b *Backend) LookupDomain(name string) (backend.Domain, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d, ok := b.domains[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: domain %s", backend.ErrNotFound, name)
+	}
+	return d, nil
+}
+
+func (b *Backend) DefineDomain(xml string) (backend.Domain, error) {
+	var xmlDomain libvirtxml.Domain
+	if err := xmlDomain.Unmarshal(xml); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d, ok := b.domains[xmlDomain.Name]
+	if !ok {
+		d = &Domain{backend: b, name: xmlDomain.Name, state: backend.DomainShutoff, snapshots: make(map[string]*Snapshot)}
+		b.domains[xmlDomain.Name] = d
+	}
+	d.xml = xml
+	return d, nil
+}
+
+func (b *Backend) ListNetworks() ([]backend.Network, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var networks []backend.Network
+	for _, name := range sortedKeys(b.networks) {
+		networks = append(networks, b.networks[name])
+	}
+	return networks, nil
+}
+
+func (b *Backend) LookupNetwork(name string) (backend.Network, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, ok := b.networks[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: network %s", backend.ErrNotFound, name)
+	}
+	return n, nil
+}
+
+func (b *Backend) DefineNetwork(xml string) (backend.Network, error) {
+	var xmlNetwork libvirtxml.Network
+	if err := xmlNetwork.Unmarshal(xml); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, ok := b.networks[xmlNetwork.Name]
+	if !ok {
+		n = &Network{backend: b, name: xmlNetwork.Name}
+		b.networks[xmlNetwork.Name] = n
+	}
+	n.xml = xml
+	return n, nil
+}
+
+func (b *Backend) LookupStoragePool(name string) (backend.StoragePool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.pools[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: storage pool %s", backend.ErrNotFound, name)
+	}
+	return p, nil
+}
+
+func (b *Backend) DefineStoragePool(xml string) (backend.StoragePool, error) {
+	var xmlPool libvirtxml.StoragePool
+	if err := xmlPool.Unmarshal(xml); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.pools[xmlPool.Name]
+	if !ok {
+		p = &StoragePool{backend: b, name: xmlPool.Name, volumes: make(map[string]*StorageVolume)}
+		b.pools[xmlPool.Name] = p
+	}
+	if xmlPool.Target != nil {
+		p.path = xmlPool.Target.Path
+	}
+	return p, nil
+}
+
+type Domain struct {
+	backend   *Backend
+	name      string
+	xml       string
+	state     backend.DomainState
+	autostart bool
+	snapshots map[string]*Snapshot
+}
+
+func (d *Domain) Name() (string, error) {
+	return d.name, nil
+}
+
+func (d *Domain) XML() (string, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	return d.xml, nil
+}
+
+func (d *Domain) IsActive() (bool, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	return d.isActive(), nil
+}
+
+func (d *Domain) isActive() bool {
+	return d.state != backend.DomainShutoff
+}
+
+func (d *Domain) State() (backend.DomainState, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	return d.state, nil
+}
+
+func (d *Domain) Create() error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if d.isActive() {
+		return fmt.Errorf("domain %s is already active", d.name)
+	}
+	d.state = backend.DomainRunning
+	return nil
+}
+
+// Shutdown powers the domain off right away, as if the guest reacted to
+// the ACPI event instantly.
+func (d *Domain) Shutdown() error {
+	return d.Destroy()
+}
+
+func (d *Domain) Destroy() error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if !d.isActive() {
+		return fmt.Errorf("domain %s is not running", d.name)
+	}
+	d.state = backend.DomainShutoff
+	return nil
+}
+
+func (d *Domain) Reboot() error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if d.state != backend.DomainRunning {
+		return fmt.Errorf("domain %s is not running", d.name)
+	}
+	return nil
+}
+
+func (d *Domain) Suspend() error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if d.state != backend.DomainRunning {
+		return fmt.Errorf("domain %s is not running", d.name)
+	}
+	d.state = backend.DomainPaused
+	return nil
+}
+
+func (d *Domain) Resume() error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if d.state != backend.DomainPaused {
+		return fmt.Errorf("domain %s is not paused", d.name)
+	}
+	d.state = backend.DomainRunning
+	return nil
+}
+
+// Undefine fails for domains with snapshots, as libvirt does without
+// DOMAIN_UNDEFINE_SNAPSHOTS_METADATA.
+func (d *Domain) Undefine() error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if len(d.snapshots) > 0 {
+		return fmt.Errorf("cannot undefine domain %s with %d snapshots", d.name, len(d.snapshots))
+	}
+	delete(d.backend.domains, d.name)
+	return nil
+}
+
+func (d *Domain) SetAutostart(autostart bool) error {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	d.autostart = autostart
+	return nil
+}
+
+func (d *Domain) InterfaceAddresses(source backend.AddressSource) ([]backend.Interface, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if source == backend.AddressesFromAgent {
+		if d.backend.agents[d.name] == nil {
+			return nil, fmt.Errorf("guest agent of domain %s is not connected", d.name)
+		}
+		return d.backend.agentAddresses[d.name], nil
+	}
+	return d.backend.addresses[d.name], nil
+}
+
+// AgentCommand passes the command to the handler set with SetAgent.
+func (d *Domain) AgentCommand(command string, timeout time.Duration) (string, error) {
+	d.backend.mu.Lock()
+	agent := d.backend.agents[d.name]
+	running := d.state == backend.DomainRunning
+	d.backend.mu.Unlock()
+	if !running {
+		return "", fmt.Errorf("domain %s is not running", d.name)
+	}
+	if agent == nil {
+		return "", fmt.Errorf("guest agent of domain %s is not connected", d.name)
+	}
+	return agent(command)
+}
+
+// OpenConsole returns a console echoing everything written to it, like a
+// terminal with local echo.
+func (d *Domain) OpenConsole(force bool) (io.ReadWriteCloser, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if d.state != backend.DomainRunning {
+		return nil, fmt.Errorf("domain %s is not running", d.name)
+	}
+	console, guest := net.Pipe()
+	go func() {
+		io.Copy(guest, guest)
+		guest.Close()
+	}()
+	return console, nil
+}
+
+// CreateSnapshot records the snapshot together with the current domain
+// state, which Revert restores.
+func (d *Domain) CreateSnapshot(xml string) (backend.Snapshot, error) {
+	var xmlSnapshot libvirtxml.DomainSnapshot
+	if err := xmlSnapshot.Unmarshal(xml); err != nil {
+		return nil, err
+	}
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	if xmlSnapshot.Name == "" {
+		xmlSnapshot.Name = fmt.Sprintf("%d", len(d.snapshots)+1)
+	}
+	if _, ok := d.snapshots[xmlSnapshot.Name]; ok {
+		return nil, fmt.Errorf("snapshot %s already exists for domain %s", xmlSnapshot.Name, d.name)
+	}
+	xmlSnapshot.State = string(d.state)
+	snapXML, err := xmlSnapshot.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{domain: d, name: xmlSnapshot.Name, xml: snapXML, state: d.state}
+	d.snapshots[s.name] = s
+	return s, nil
+}
+
+func (d *Domain) ListSnapshots() ([]backend.Snapshot, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	var snapshots []backend.Snapshot
+	for _, name := range sortedKeys(d.snapshots) {
+		snapshots = append(snapshots, d.snapshots[name])
+	}
+	return snapshots, nil
+}
+
+func (d *Domain) LookupSnapshot(name string) (backend.Snapshot, error) {
+	d.backend.mu.Lock()
+	defer d.backend.mu.Unlock()
+	s, ok := d.snapshots[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: snapshot %s of domain %s", backend.ErrNotFound, name, d.name)
+	}
+	return s, nil
+}
+
+type Snapshot struct {
+	domain *Domain
+	name   string
+	xml    string
+	state  backend.DomainState
+}
+
+func (s *Snapshot) Name() (string, error) {
+	return s.name, nil
+}
+
+func (s *Snapshot) XML() (string, error) {
+	return s.xml, nil
+}
+
+func (s *Snapshot) Revert(running bool) error {
+	s.domain.backend.mu.Lock()
+	defer s.domain.backend.mu.Unlock()
+	s.domain.state = s.state
+	if running {
+		s.domain.state = backend.DomainRunning
+	}
+	return nil
+}
+
+func (s *Snapshot) Delete() error {
+	s.domain.backend.mu.Lock()
+	defer s.domain.backend.mu.Unlock()
+	delete(s.domain.snapshots, s.name)
+	return nil
+}
+
+type Network struct {
+	backend   *Backend
+	name      string
+	xml       string
+	active    bool
+	autostart bool
+}
+
+func (n *Network) Name() (string, error) {
+	return n.name, nil
+}
+
+func (n *Network) XML() (string, error) {
+	n.backend.mu.Lock()
+	defer n.backend.mu.Unlock()
+	return n.xml, nil
+}
+
+func (n *Network) IsActive() (bool, error) {
+	n.backend.mu.Lock()
+	defer n.backend.mu.Unlock()
+	return n.active, nil
+}
+
+func (n *Network) Create() error {
+	n.backend.mu.Lock()
+	defer n.backend.mu.Unlock()
+	n.active = true
+	return nil
+}
+
+func (n *Network) Destroy() error {
+	n.backend.mu.Lock()
+	defer n.backend.mu.Unlock()
+	n.active = false
+	return nil
+}
+
+func (n *Network) Undefine() error {
+	n.backend.mu.Lock()
+	defer n.backend.mu.Unlock()
+	delete(n.backend.networks, n.name)
+	return nil
+}
+
+func (n *Network) SetAutostart(autostart bool) error {
+	n.backend.mu.Lock()
+	defer n.backend.mu.Unlock()
+	n.autostart = autostart
+	return nil
+}
+
+func (n *Network) AddDHCPHost(xml string) error {
+	return n.updateDHCPHosts(xml, func(hosts []libvirtxml.NetworkDHCPHost, host libvirtxml.NetworkDHCPHost) ([]libvirtxml.NetworkDHCPHost, error) {
+		for _, h := range hosts {
+			if h.MAC == host.MAC || h.IP == host.IP {
+				return nil, fmt.Errorf("dhcp host %s/%s conflicts with %s/%s", host.MAC, host.IP, h.MAC, h.IP)
+			}
+		}
+		return append(hosts, host), nil
+	})
+}
+
+func (n *Network) DeleteDHCPHost(xml string) error {
+	return n.updateDHCPHosts(xml, func(hosts []libvirtxml.NetworkDHCPHost, host libvirtxml.NetworkDHCPHost) ([]libvirtxml.NetworkDHCPHost, error) {
+		for idx, h := range hosts {
+			if h.MAC == host.MAC && h.IP == host.IP {
+				return append(hosts[:idx], hosts[idx+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("dhcp host %s/%s: %w", host.MAC, host.IP, backend.ErrNotFound)
+	})
+}
+
+// updateDHCPHosts applies update to the DHCP hosts of the first IP of the
+// network that has a DHCP configuration.
+func (n *Network) updateDHCPHosts(xml string, update func([]libvirtxml.NetworkDHCPHost, libvirtxml.NetworkDHCPHost) ([]libvirtxml.NetworkDHCPHost, error)) error {
+	n.backend.mu.Lock()
+	defer n.backend.mu.Unlock()
+	var host libvirtxml.NetworkDHCPHost
+	if err := host.Unmarshal(xml); err != nil {
+		return err
+	}
+	var netw libvirtxml.Network
+	if err := netw.Unmarshal(n.xml); err != nil {
+		return err
+	}
+	for idx := range netw.IPs {
+		dhcp := netw.IPs[idx].DHCP
+		if dhcp == nil {
+			continue
+		}
+		hosts, err := update(dhcp.Hosts, host)
+		if err != nil {
+			return err
+		}
+		dhcp.Hosts = hosts
+		networkXML, err := netw.Marshal()
+		if err != nil {
+			return err
+		}
+		n.xml = networkXML
+		return nil
+	}
+	return fmt.Errorf("network %s has no dhcp", n.name)
+}
+
+type StoragePool struct {
+	backend   *Backend
+	name      string
+	path      string
+	active    bool
+	autostart bool
+	volumes   map[string]*StorageVolume
+}
+
+func (p *StoragePool) XML() (string, error) {
+	p.backend.mu.Lock()
+	defer p.backend.mu.Unlock()
+	xmlPool := libvirtxml.StoragePool{
+		Type: "dir",
+		Name: p.name,
+		Target: &libvirtxml.StoragePoolTarget{
+			Path: p.path,
+		},
+	}
+	return xmlPool.Marshal()
+}
+
+func (p *StoragePool) Create() error {
+	p.backend.mu.Lock()
+	defer p.backend.mu.Unlock()
+	p.active = true
+	return nil
+}
+
+func (p *StoragePool) Destroy() error {
+	p.backend.mu.Lock()
+	defer p.backend.mu.Unlock()
+	p.active = false
+	return nil
+}
+
+func (p *StoragePool) Undefine() error {
+	p.backend.mu.Lock()
+	defer p.backend.mu.Unlock()
+	delete(p.backend.pools, p.name)
+	return nil
+}
+
+func (p *StoragePool) SetAutostart(autostart bool) error {
+	p.backend.mu.Lock()
+	defer p.backend.mu.Unlock()
+	p.autostart = autostart
+	return nil
+}
+
+func (p *StoragePool) ListVolumes() ([]backend.StorageVolume, error) {
+	p.backend.mu.Lock()
+	defer p.backend.mu.Unlock()
+	var vols []backend.StorageVolume
+	for _, name := range sortedKeys(p.volumes) {
+		vols = append(vols, p.volumes[name])
+	}
+	return vols, nil
+}
+
+func (p *StoragePool) LookupVolume(name string) (backend.StorageVolume, error) {
+	p.backend.mu.Lock()
+	defer p.backend.mu.Unlock()
+	v, ok := p.volumes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: storage volume %s", backend.ErrNotFound, name)
+	}
+	return v, nil
+}
+
+// CreateVolume stores the volume with its key and target path filled in
+// the way libvirt reports them for a dir pool.
+func (p *StoragePool) CreateVolume(xml string) (backend.StorageVolume, error) {
+	var xmlVol libvirtxml.StorageVolume
+	if err := xmlVol.Unmarshal(xml); err != nil {
+		return nil, err
+	}
+	p.backend.mu.Lock()
+	defer p.backend.mu.Unlock()
+	if _, ok := p.volumes[xmlVol.Name]; ok {
+		return nil, fmt.Errorf("storage volume %s already exists", xmlVol.Name)
+	}
+	volPath := filepath.Join(p.path, xmlVol.Name)
+	xmlVol.Key = volPath
+	if xmlVol.Target == nil {
+		xmlVol.Target = &libvirtxml.StorageVolumeTarget{}
+	}
+	xmlVol.Target.Path = volPath
+	volXML, err := xmlVol.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	v := &StorageVolume{pool: p, name: xmlVol.Name, xml: volXML}
+	p.volumes[xmlVol.Name] = v
+	return v, nil
+}
+
+type StorageVolume struct {
+	pool *StoragePool
+	name string
+	xml  string
+	data []byte
+}
+
+func (v *StorageVolume) XML() (string, error) {
+	v.pool.backend.mu.Lock()
+	defer v.pool.backend.mu.Unlock()
+	return v.xml, nil
+}
+
+func (v *StorageVolume) Delete() error {
+	v.pool.backend.mu.Lock()
+	defer v.pool.backend.mu.Unlock()
+	delete(v.pool.volumes, v.name)
+	return nil
+}
+
+func (v *StorageVolume) Upload(r io.Reader, size uint64) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return err
+	}
+	v.pool.backend.mu.Lock()
+	defer v.pool.backend.mu.Unlock()
+	v.data = data
+	return nil
+}
+
+// Data returns the bytes last uploaded to the volume.
+func (v *StorageVolume) Data() []byte {
+	v.pool.backend.mu.Lock()
+	defer v.pool.backend.mu.Unlock()
+	return v.data
+}
+
+const capabilities = `<capabilities>
+  <host>
+    <cpu>
+      <arch>x86_64</arch>
+    </cpu>
+  </host>
+  <guest>
+    <os_type>hvm</os_type>
+    <arch name='x86_64'>
+      <wordsize>64</wordsize>
+      <emulator>/usr/bin/qemu-system-x86_64</emulator>
+      <machine maxCpus='255'>pc-i440fx-6.2</machine>
+      <machine canonical='pc-i440fx-6.2' maxCpus='255'>pc</machine>
+      <machine maxCpus='288'>pc-q35-6.2</machine>
+      <machine canonical='pc-q35-6.2' maxCpus='288'>q35</machine>
+      <domain type='qemu'/>
+      <domain type='kvm'/>
+    </arch>
+  </guest>
+</capabilities>`
+
+const domainCapabilities = `<domainCapabilities>
+  <path>%s</path>
+  <domain>%s</domain>
+  <machine>%s</machine>
+  <arch>%s</arch>
+  <cpu>
+    <mode name='host-passthrough' supported='yes'/>
+    <mode name='host-model' supported='yes'/>
+    <mode name='custom' supported='yes'>
+      <model usable='yes'>qemu64</model>
+    </mode>
+  </cpu>
+</domainCapabilities>`
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*Domain:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*Network:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*Snapshot:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*StorageVolume:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
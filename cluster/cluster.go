@@ -3,8 +3,10 @@ package cluster
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/michaelhenkel/gokvm/backend"
 	"github.com/michaelhenkel/gokvm/image"
 	"github.com/michaelhenkel/gokvm/instance"
 	"github.com/michaelhenkel/gokvm/network"
@@ -14,18 +16,34 @@ import (
 
 type Cluster struct {
 	Name       string
-	Network    network.Network
+	Networks   []instance.NetworkAttachment
 	Image      image.Image
 	Suffix     string
 	Worker     int
 	Controller int
 	PublicKey  string
-	Resources  instance.Resources
-	Instances  []*instance.Instance
+	// SSHKey is the path of the private key matching PublicKey.
+	SSHKey    string
+	Resources instance.Resources
+	Platform  instance.Platform
+	// DomainTemplates maps a role to the domain template of its
+	// instances, the empty role applies to all roles without an entry.
+	DomainTemplates map[instance.Role]string
+	// UserData maps a role to a user-data file for its instances, the
+	// file for the empty role is used by all instances and merged first.
+	UserData map[instance.Role]string
+	// StaticIP configures the instances with addresses allocated from the
+	// network subnets instead of DHCP.
+	StaticIP bool
+	// User is the login created on the instances, the default user of
+	// the image distro if empty.
+	User        string
+	Credentials instance.Credentials
+	Instances   []*instance.Instance
 }
 
-func List() ([]*Cluster, error) {
-	instances, err := instance.List("")
+func List(l backend.Backend) ([]*Cluster, error) {
+	instances, err := instance.List(l, "")
 	if err != nil {
 		return nil, err
 	}
@@ -48,11 +66,14 @@ func Render(clusters []*Cluster) {
 	rowConfigAutoMerge := table.RowConfig{AutoMerge: true}
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
-	t.AppendHeader(table.Row{"Cluster", "Instances", "IP"})
+	t.AppendHeader(table.Row{"Cluster", "Instances", "State", "Network", "MAC", "IP"})
 	for _, cluster := range clusters {
 		for _, inst := range cluster.Instances {
-			for _, addr := range inst.IPAddresses {
-				t.AppendRow(table.Row{cluster.Name, inst.Name, addr}, rowConfigAutoMerge)
+			if len(inst.Interfaces) == 0 {
+				t.AppendRow(table.Row{cluster.Name, inst.Name, inst.State, "", "", ""}, rowConfigAutoMerge)
+			}
+			for _, intf := range inst.Interfaces {
+				t.AppendRow(table.Row{cluster.Name, inst.Name, inst.State, intf.Network, intf.MAC, strings.Join(intf.IPAddresses, "\n")}, rowConfigAutoMerge)
 			}
 		}
 
@@ -64,21 +85,21 @@ func Render(clusters []*Cluster) {
 	t.Render()
 }
 
-func (c *Cluster) Delete() error {
-	instances, err := instance.List(c.Name)
+func (c *Cluster) Delete(l backend.Backend) error {
+	instances, err := instance.List(l, c.Name)
 	if err != nil {
 		return err
 	}
 	for _, inst := range instances {
-		if err := inst.Delete(); err != nil {
+		if err := inst.Delete(l); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Cluster) Create() error {
-	instances, err := instance.List(c.Name)
+func (c *Cluster) Create(l backend.Backend) error {
+	instances, err := instance.List(l, c.Name)
 	if err != nil {
 		return err
 	}
@@ -87,14 +108,21 @@ func (c *Cluster) Create() error {
 		return nil
 	}
 
-	imageExists, err := image.Get(c.Image.Name, c.Image.Pool)
+	imageExists, err := image.Get(l, c.Image.Name, c.Image.Pool)
 	if err != nil {
 		return err
 	}
 	if imageExists == nil {
 		defaultImage := image.DefaultImage()
+		entry, err := image.LookupCatalog(c.Image.Name)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			defaultImage = entry.Image()
+		}
 		defaultImage.Name = c.Image.Name
-		if err := defaultImage.Create(); err != nil {
+		if err := defaultImage.Create(l); err != nil {
 			return err
 		}
 		c.Image = defaultImage
@@ -102,49 +130,165 @@ func (c *Cluster) Create() error {
 		c.Image = *imageExists
 	}
 
-	networkExists, err := network.Get(c.Network.Name)
-	if err != nil {
-		return err
+	if len(c.Networks) == 0 {
+		return fmt.Errorf("cluster %s has no network", c.Name)
 	}
-	if networkExists == nil {
+	for idx := range c.Networks {
+		attachment := &c.Networks[idx]
+		if attachment.MAC != "" && c.Controller+c.Worker > 1 {
+			return fmt.Errorf("mac %s for network %s would be shared by all instances", attachment.MAC, attachment.Network.Name)
+		}
+		networkExists, err := network.Get(l, attachment.Network.Name)
+		if err != nil {
+			return err
+		}
+		if networkExists != nil {
+			attachment.Network = *networkExists
+			continue
+		}
+		// Only the management network is created on demand, the
+		// default subnet cannot be shared by several networks.
+		if idx > 0 {
+			return fmt.Errorf("network %s does not exist", attachment.Network.Name)
+		}
 		defaultNetwork := network.DefaultNetwork()
-		defaultNetwork.Name = c.Network.Name
-		if err := defaultNetwork.Create(); err != nil {
+		defaultNetwork.Name = attachment.Network.Name
+		if err := defaultNetwork.Create(l); err != nil {
 			return err
 		}
-		c.Network = defaultNetwork
-	} else {
-		c.Network = *networkExists
+		attachment.Network = defaultNetwork
 	}
 
-	for i := 0; i < c.Controller; i++ {
-		inst := instance.Instance{
-			Name:        fmt.Sprintf("c-instance-%d.%s.%s", i, c.Name, c.Suffix),
-			PubKey:      c.PublicKey,
-			Network:     c.Network,
-			Image:       c.Image,
-			ClusterName: c.Name,
-			Suffix:      c.Suffix,
-			Resources:   c.Resources,
-		}
-		if err := inst.Create(); err != nil {
+	platform, err := instance.DetectPlatform(l, c.Platform)
+	if err != nil {
+		return err
+	}
+	instances = c.plannedInstances(platform)
+	if c.StaticIP {
+		if err := assignAddresses(l, instances); err != nil {
 			return err
 		}
 	}
-	for i := 0; i < c.Worker; i++ {
-		inst := instance.Instance{
-			Name:        fmt.Sprintf("w-instance-%d.%s.%s", i, c.Name, c.Suffix),
-			PubKey:      c.PublicKey,
-			Network:     c.Network,
-			Image:       c.Image,
-			ClusterName: c.Name,
-			Suffix:      c.Suffix,
-			Resources:   c.Resources,
-		}
-		if err := inst.Create(); err != nil {
+	setPeers(instances)
+	for _, inst := range instances {
+		if err := inst.Create(l); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// plannedInstances returns the controllers and workers of the cluster in
+// creation order.
+func (c *Cluster) plannedInstances(platform instance.Platform) []*instance.Instance {
+	var instances []*instance.Instance
+	roles := []struct {
+		role   instance.Role
+		prefix string
+		count  int
+	}{
+		{instance.Controller, "c", c.Controller},
+		{instance.Worker, "w", c.Worker},
+	}
+	for _, r := range roles {
+		for i := 0; i < r.count; i++ {
+			instances = append(instances, &instance.Instance{
+				Name:           fmt.Sprintf("%s-instance-%d.%s.%s", r.prefix, i, c.Name, c.Suffix),
+				PubKey:         c.PublicKey,
+				SSHKey:         c.SSHKey,
+				Networks:       append([]instance.NetworkAttachment(nil), c.Networks...),
+				Image:          c.Image,
+				ClusterName:    c.Name,
+				Suffix:         c.Suffix,
+				Resources:      c.Resources,
+				Platform:       platform,
+				Role:           r.role,
+				Index:          i,
+				DomainTemplate: c.domainTemplate(r.role),
+				UserData:       c.userData(r.role),
+				User:           c.User,
+				Credentials:    c.Credentials,
+			})
+		}
+	}
+	return instances
+}
+
+// assignAddresses allocates a static address on every network with a
+// subnet for the instances. Addresses of existing instances are skipped.
+func assignAddresses(l backend.Backend, instances []*instance.Instance) error {
+	existing, err := instance.List(l, "")
+	if err != nil {
+		return err
+	}
+	used := make(map[string]map[string]bool)
+	for _, inst := range existing {
+		for _, intf := range inst.Interfaces {
+			if used[intf.Network] == nil {
+				used[intf.Network] = make(map[string]bool)
+			}
+			for _, addr := range intf.IPAddresses {
+				used[intf.Network][addr] = true
+			}
+		}
+	}
+	for _, inst := range instances {
+		for idx := range inst.Networks {
+			attachment := &inst.Networks[idx]
+			if attachment.Network.Subnet == nil {
+				continue
+			}
+			netwUsed := used[attachment.Network.Name]
+			if netwUsed == nil {
+				netwUsed = make(map[string]bool)
+				used[attachment.Network.Name] = netwUsed
+			}
+			ip, err := attachment.Network.AllocateIP(inst.Name, netwUsed)
+			if err != nil {
+				return err
+			}
+			netwUsed[ip.String()] = true
+			attachment.IP = ip
+		}
+	}
+	return nil
+}
+
+// setPeers tells every instance about the others.
+func setPeers(instances []*instance.Instance) {
+	for _, inst := range instances {
+		inst.Peers = nil
+		for _, other := range instances {
+			if other == inst {
+				continue
+			}
+			peer := instance.Peer{
+				Name:  other.Name,
+				Role:  other.Role,
+				Index: other.Index,
+			}
+			if len(other.Networks) > 0 {
+				peer.Address = other.Networks[0].IP
+			}
+			inst.Peers = append(inst.Peers, peer)
+		}
+	}
+}
+
+func (c *Cluster) userData(role instance.Role) []string {
+	var files []string
+	for _, r := range []instance.Role{"", role} {
+		if file, ok := c.UserData[r]; ok {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (c *Cluster) domainTemplate(role instance.Role) string {
+	if tmpl, ok := c.DomainTemplates[role]; ok {
+		return tmpl
+	}
+	return c.DomainTemplates[""]
+}
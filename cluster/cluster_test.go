@@ -0,0 +1,236 @@
+package cluster
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/backend/fake"
+	"github.com/michaelhenkel/gokvm/image"
+	"github.com/michaelhenkel/gokvm/instance"
+	"github.com/michaelhenkel/gokvm/network"
+)
+
+// newTestBackend returns a fake backend with the base image test-image in
+// the gokvm pool. HOME points to a temporary directory so the local
+// stores of gokvm stay out of the real one.
+func newTestBackend(t *testing.T) *fake.Backend {
+	t.Helper()
+	dir := t.TempDir()
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	t.Cleanup(func() { os.Setenv("HOME", home) })
+	imagePath := filepath.Join(dir, "test-image.qcow2")
+	// a qcow2 header of a 10G image is all the import looks at
+	header := append([]byte("QFI\xfb\x00\x00\x00\x03"), make([]byte, 16)...)
+	header = append(header, 0, 0, 0, 2, 0x80, 0, 0, 0)
+	if err := os.WriteFile(imagePath, header, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := fake.New()
+	img := image.Image{
+		Name:              "test-image",
+		Pool:              "gokvm",
+		Path:              dir,
+		ImageLocationType: image.File,
+		ImageLocation:     imagePath,
+		Distro:            "ubuntu-22.04",
+	}
+	if err := img.Create(l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func newTestCluster(name string, controller, worker int) *Cluster {
+	return &Cluster{
+		Name: name,
+		Networks: []instance.NetworkAttachment{{
+			Network: network.Network{Name: "gokvm"},
+		}},
+		Image:      image.Image{Name: "test-image", Pool: "gokvm"},
+		Suffix:     "local",
+		Controller: controller,
+		Worker:     worker,
+		PublicKey:  "ssh-rsa AAAA test\n",
+		Resources:  instance.Resources{CPU: 1, Memory: 1 << 30, Disk: "10G"},
+		StaticIP:   true,
+	}
+}
+
+func volumeNames(t *testing.T, l backend.Backend) []string {
+	t.Helper()
+	images, err := image.List(l, "gokvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, img := range images {
+		names = append(names, img.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCreateListDelete(t *testing.T) {
+	l := newTestBackend(t)
+	cl := newTestCluster("test", 1, 2)
+	if err := cl.Create(l); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := List(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || clusters[0].Name != "test" {
+		t.Fatalf("got clusters %v, want test", clusters)
+	}
+	roles := map[instance.Role]int{}
+	for _, inst := range clusters[0].Instances {
+		roles[inst.Role]++
+		if inst.State != backend.DomainRunning {
+			t.Errorf("instance %s is %s, want running", inst.Name, inst.State)
+		}
+	}
+	if roles[instance.Controller] != 1 || roles[instance.Worker] != 2 {
+		t.Errorf("got roles %v, want 1 controller and 2 workers", roles)
+	}
+	want := []string{
+		"c-instance-0.test.local", "c-instance-0.test.local-cloudinit",
+		"test-image",
+		"w-instance-0.test.local", "w-instance-0.test.local-cloudinit",
+		"w-instance-1.test.local", "w-instance-1.test.local-cloudinit",
+	}
+	if got := volumeNames(t, l); !equal(got, want) {
+		t.Errorf("got volumes %v, want %v", got, want)
+	}
+
+	// creating an existing cluster changes nothing
+	if err := newTestCluster("test", 2, 2).Create(l); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := instance.List(l, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 3 {
+		t.Errorf("got %d instances after recreating, want 3", len(instances))
+	}
+
+	if err := cl.Delete(l); err != nil {
+		t.Fatal(err)
+	}
+	if instances, err = instance.List(l, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 0 {
+		t.Errorf("got %d instances after delete, want none", len(instances))
+	}
+	if got := volumeNames(t, l); !equal(got, []string{"test-image"}) {
+		t.Errorf("got volumes %v after delete, want only the base image", got)
+	}
+	netw, err := network.Get(l, "gokvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(netw.Reservations) != 0 {
+		t.Errorf("got reservations %v after delete, want none", netw.Reservations)
+	}
+}
+
+func TestCreateStaticAddresses(t *testing.T) {
+	tests := []struct {
+		name string
+		// networkXML defines the gokvm network, created by the cluster
+		// if empty
+		networkXML string
+	}{
+		{"default network", ""},
+		{"DHCP range over the subnet", `<network><name>gokvm</name>
+			<metadata>` + network.NetworkMetadata + `</metadata><forward mode="nat"/>
+			<ip address="192.168.66.1" netmask="255.255.255.0"><dhcp>
+			<range start="192.168.66.2" end="192.168.66.254"/>
+			</dhcp></ip></network>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestBackend(t)
+			if tt.networkXML != "" {
+				lnetwork, err := l.DefineNetwork(tt.networkXML)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := lnetwork.Create(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := newTestCluster("test", 2, 1).Create(l); err != nil {
+				t.Fatal(err)
+			}
+			netw, err := network.Get(l, "gokvm")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(netw.Reservations) != 3 {
+				t.Fatalf("got reservations %v, want 3", netw.Reservations)
+			}
+			seen := map[string]bool{}
+			for _, r := range netw.Reservations {
+				if seen[r.IP.String()] {
+					t.Errorf("address %s is reserved twice", r.IP)
+				}
+				seen[r.IP.String()] = true
+				if !netw.Subnet.Contains(r.IP) {
+					t.Errorf("address %s is outside of %s", r.IP, netw.Subnet)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateFailureRollsBack(t *testing.T) {
+	tests := []struct {
+		name      string
+		disk      string
+		dataDisks []string
+	}{
+		{"root disk", "bogus", nil},
+		{"data disk", "10G", []string{"1G", "bogus"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestBackend(t)
+			cl := newTestCluster("test", 1, 0)
+			cl.Resources.Disk = tt.disk
+			cl.Resources.DataDisks = tt.dataDisks
+			if err := cl.Create(l); err == nil {
+				t.Fatal("creating a cluster with a bogus disk size succeeded")
+			}
+			netw, err := network.Get(l, "gokvm")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(netw.Reservations) != 0 {
+				t.Errorf("got reservations %v after a failed create, want none", netw.Reservations)
+			}
+			if got := volumeNames(t, l); !equal(got, []string{"test-image"}) {
+				t.Errorf("got volumes %v after a failed create, want only the base image", got)
+			}
+		})
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
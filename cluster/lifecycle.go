@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/instance"
+)
+
+func (c *Cluster) Start(l backend.Backend) error {
+	return c.forEachInstance(l, func(inst *instance.Instance) error {
+		return inst.Start(l)
+	})
+}
+
+func (c *Cluster) Stop(l backend.Backend, timeout time.Duration) error {
+	return c.forEachInstance(l, func(inst *instance.Instance) error {
+		return inst.Stop(l, timeout)
+	})
+}
+
+func (c *Cluster) Reboot(l backend.Backend) error {
+	return c.forEachInstance(l, func(inst *instance.Instance) error {
+		return inst.Reboot(l)
+	})
+}
+
+func (c *Cluster) Suspend(l backend.Backend) error {
+	return c.forEachInstance(l, func(inst *instance.Instance) error {
+		return inst.Suspend(l)
+	})
+}
+
+func (c *Cluster) Resume(l backend.Backend) error {
+	return c.forEachInstance(l, func(inst *instance.Instance) error {
+		return inst.Resume(l)
+	})
+}
+
+// Wait blocks until all instances are ready, see instance.WaitReady.
+func (c *Cluster) Wait(l backend.Backend, timeout time.Duration) error {
+	return c.forEachInstance(l, func(inst *instance.Instance) error {
+		return inst.WaitReady(l, timeout)
+	})
+}
+
+// forEachInstance runs fn concurrently for every instance of the cluster
+// and reports the instances it failed for.
+func (c *Cluster) forEachInstance(l backend.Backend, fn func(inst *instance.Instance) error) error {
+	instances, err := instance.List(l, c.Name)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return fmt.Errorf("cluster %s not found", c.Name)
+	}
+	c.Instances = instances
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(instances))
+	for idx, inst := range instances {
+		wg.Add(1)
+		go func(idx int, inst *instance.Instance) {
+			defer wg.Done()
+			errs[idx] = fn(inst)
+		}(idx, inst)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for idx, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", instances[idx].Name, err))
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("cluster %s: %s", c.Name, strings.Join(msgs, "; "))
+	}
+	return nil
+}
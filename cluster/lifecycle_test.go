@@ -0,0 +1,64 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/instance"
+)
+
+func clusterStates(t *testing.T, l backend.Backend, name string) map[string]backend.DomainState {
+	t.Helper()
+	instances, err := instance.List(l, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]backend.DomainState{}
+	for _, inst := range instances {
+		states[inst.Name] = inst.State
+	}
+	return states
+}
+
+func TestLifecycle(t *testing.T) {
+	l := newTestBackend(t)
+	cl := newTestCluster("test", 1, 1)
+	if err := cl.Create(l); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name string
+		fn   func() error
+		want backend.DomainState
+	}{
+		{"suspend", func() error { return cl.Suspend(l) }, backend.DomainPaused},
+		{"suspend again", func() error { return cl.Suspend(l) }, backend.DomainPaused},
+		{"resume", func() error { return cl.Resume(l) }, backend.DomainRunning},
+		{"reboot", func() error { return cl.Reboot(l) }, backend.DomainRunning},
+		{"stop", func() error { return cl.Stop(l, time.Second) }, backend.DomainShutoff},
+		{"stop again", func() error { return cl.Stop(l, time.Second) }, backend.DomainShutoff},
+		{"start", func() error { return cl.Start(l) }, backend.DomainRunning},
+		{"start again", func() error { return cl.Start(l) }, backend.DomainRunning},
+	}
+	for _, step := range steps {
+		if err := step.fn(); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		for name, state := range clusterStates(t, l, "test") {
+			if state != step.want {
+				t.Errorf("%s: instance %s is %s, want %s", step.name, name, state, step.want)
+			}
+		}
+	}
+
+	if err := cl.Stop(l, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Suspend(l); err == nil {
+		t.Error("suspending a stopped cluster succeeded")
+	}
+	if err := (&Cluster{Name: "missing"}).Start(l); err == nil {
+		t.Error("starting a missing cluster succeeded")
+	}
+}
@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/instance"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Snapshot is a cluster snapshot made of one domain snapshot per
+// instance, all sharing the same name.
+type Snapshot struct {
+	Name         string
+	Cluster      string
+	CreationTime time.Time
+	Instances    []string
+	// Complete is false if some cluster instance lacks the snapshot.
+	Complete bool
+}
+
+// CreateSnapshot pauses all running instances, snapshots each of them and
+// resumes them, so the member snapshots are taken at the same point.
+func (c *Cluster) CreateSnapshot(l backend.Backend, name string) error {
+	instances, err := instance.List(l, c.Name)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return fmt.Errorf("cluster %s not found", c.Name)
+	}
+	var paused []*instance.Instance
+	defer func() {
+		for _, inst := range paused {
+			if err := inst.Resume(l); err != nil {
+				log.Errorf("failed to resume %s: %s", inst.Name, err)
+			}
+		}
+	}()
+	for _, inst := range instances {
+		if inst.State != backend.DomainRunning {
+			continue
+		}
+		if err := inst.Suspend(l); err != nil {
+			return err
+		}
+		paused = append(paused, inst)
+	}
+	var created []*instance.Instance
+	for _, inst := range instances {
+		if err := inst.CreateSnapshot(l, name, true); err != nil {
+			for _, done := range created {
+				if err := done.DeleteSnapshot(l, name); err != nil {
+					log.Errorf("failed to remove snapshot %s of %s: %s", name, done.Name, err)
+				}
+			}
+			return fmt.Errorf("%s: %s", inst.Name, err)
+		}
+		created = append(created, inst)
+	}
+	return nil
+}
+
+func (c *Cluster) ListSnapshots(l backend.Backend) ([]*Snapshot, error) {
+	instances, err := instance.List(l, c.Name)
+	if err != nil {
+		return nil, err
+	}
+	snapshotMap := make(map[string]*Snapshot)
+	for _, inst := range instances {
+		instSnapshots, err := inst.ListSnapshots(l)
+		if err != nil {
+			return nil, err
+		}
+		for _, instSnap := range instSnapshots {
+			if instSnap.ClusterName == "" {
+				continue
+			}
+			snap, ok := snapshotMap[instSnap.Name]
+			if !ok {
+				snap = &Snapshot{
+					Name:         instSnap.Name,
+					Cluster:      instSnap.ClusterName,
+					CreationTime: instSnap.CreationTime,
+				}
+				snapshotMap[instSnap.Name] = snap
+			}
+			snap.Instances = append(snap.Instances, inst.Name)
+		}
+	}
+	var snapshots []*Snapshot
+	for _, snap := range snapshotMap {
+		snap.Complete = len(snap.Instances) == len(instances)
+		snapshots = append(snapshots, snap)
+	}
+	sort.Slice(snapshots, func(a, b int) bool {
+		return snapshots[a].CreationTime.Before(snapshots[b].CreationTime)
+	})
+	return snapshots, nil
+}
+
+// RevertSnapshot reverts every instance to the cluster snapshot. It
+// refuses to revert a snapshot that not all instances have.
+func (c *Cluster) RevertSnapshot(l backend.Backend, name string) error {
+	snap, err := c.getSnapshot(l, name)
+	if err != nil {
+		return err
+	}
+	if !snap.Complete {
+		return fmt.Errorf("snapshot %s only exists for %s", name, strings.Join(snap.Instances, ", "))
+	}
+	return c.forEachInstance(l, func(inst *instance.Instance) error {
+		return inst.RevertSnapshot(l, name)
+	})
+}
+
+func (c *Cluster) DeleteSnapshot(l backend.Backend, name string) error {
+	snap, err := c.getSnapshot(l, name)
+	if err != nil {
+		return err
+	}
+	for _, instName := range snap.Instances {
+		inst := &instance.Instance{
+			Name: instName,
+		}
+		if err := inst.DeleteSnapshot(l, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) getSnapshot(l backend.Backend, name string) (*Snapshot, error) {
+	snapshots, err := c.ListSnapshots(l)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range snapshots {
+		if snap.Name == name {
+			return snap, nil
+		}
+	}
+	return nil, fmt.Errorf("cluster %s has no snapshot %s", c.Name, name)
+}
+
+func RenderSnapshots(snapshots []*Snapshot) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Cluster", "Snapshot", "Created", "Instances", "Complete"})
+	var tableRows []table.Row
+	for _, snap := range snapshots {
+		tableRows = append(tableRows, table.Row{snap.Cluster, snap.Name, snap.CreationTime.Format(time.RFC3339), strings.Join(snap.Instances, "\n"), snap.Complete})
+	}
+	t.AppendRows(tableRows)
+	t.SetStyle(table.StyleLight)
+	t.Render()
+}
@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/instance"
+)
+
+func TestRevertSnapshot(t *testing.T) {
+	l := newTestBackend(t)
+	cl := newTestCluster("test", 1, 1)
+	if err := cl.Create(l); err != nil {
+		t.Fatal(err)
+	}
+	stopped, err := instance.Get(l, "w-instance-0.test.local", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stopped.Stop(l, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.CreateSnapshot(l, "base"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]backend.DomainState{
+		"c-instance-0.test.local": backend.DomainRunning,
+		"w-instance-0.test.local": backend.DomainShutoff,
+	}
+	check := func(step string) {
+		t.Helper()
+		for name, state := range clusterStates(t, l, "test") {
+			if state != want[name] {
+				t.Errorf("%s: instance %s is %s, want %s", step, name, state, want[name])
+			}
+		}
+	}
+	check("after snapshot")
+
+	if err := cl.Stop(l, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.RevertSnapshot(l, "base"); err != nil {
+		t.Fatal(err)
+	}
+	check("after revert")
+}
+
+func TestDeleteWithSnapshots(t *testing.T) {
+	l := newTestBackend(t)
+	cl := newTestCluster("test", 1, 1)
+	if err := cl.Create(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.CreateSnapshot(l, "base"); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := instance.List(l, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := instances[0].CreateSnapshot(l, "single", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Delete(l); err != nil {
+		t.Fatal(err)
+	}
+	if instances, err = instance.List(l, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 0 {
+		t.Errorf("got %d instances after delete, want none", len(instances))
+	}
+}
@@ -2,7 +2,11 @@ package cmd
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/michaelhenkel/gokvm/cluster"
@@ -16,7 +20,7 @@ import (
 
 var (
 	img        string
-	nw         string
+	nws        []string
 	suffix     string
 	worker     int
 	controller int
@@ -24,12 +28,26 @@ var (
 	cpu        int
 	memory     string
 	disk       string
+	dataDisks  []string
+	emulator   string
+	machine    string
+	cpuMode    string
+	cpuModel   string
+	domainTmpl []string
+	userData   []string
+	wait       bool
+	waitTime   time.Duration
+	staticIP   bool
+	guestUser  string
+	password   string
+	passwdHash string
+	rootLogin  bool
+	sshPwAuth  bool
 )
 
 func init() {
-	cobra.OnInitialize(initImageConfig)
 	createClusterCmd.PersistentFlags().StringVarP(&img, "image", "i", "default", "")
-	createClusterCmd.PersistentFlags().StringVarP(&nw, "network", "l", "gokvm", "")
+	createClusterCmd.PersistentFlags().StringArrayVarP(&nws, "network", "l", []string{"gokvm"}, "network to attach as name[,mac=<mac>][,model=<model>], repeat for more NICs")
 	createClusterCmd.PersistentFlags().StringVarP(&suffix, "suffix", "s", "local", "")
 	createClusterCmd.PersistentFlags().IntVarP(&worker, "worker", "w", 0, "")
 	createClusterCmd.PersistentFlags().IntVarP(&controller, "controller", "c", 1, "")
@@ -37,10 +55,21 @@ func init() {
 	createClusterCmd.PersistentFlags().IntVarP(&cpu, "cpu", "v", 4, "")
 	createClusterCmd.PersistentFlags().StringVarP(&disk, "disk", "d", "10G", "")
 	createClusterCmd.PersistentFlags().StringVarP(&pubKeyPath, "publickey", "k", "", "")
-
-}
-
-func initClusterConfig() {
+	createClusterCmd.PersistentFlags().StringArrayVar(&dataDisks, "data-disk", nil, "size of an additional blank disk per instance, repeat for more disks")
+	createClusterCmd.PersistentFlags().StringVar(&emulator, "emulator", "", "emulator binary, detected from the host capabilities if empty")
+	createClusterCmd.PersistentFlags().StringVar(&machine, "machine", "", "machine type, defaults to the newest q35 machine")
+	createClusterCmd.PersistentFlags().StringVar(&cpuMode, "cpu-mode", "", "host-model, host-passthrough or custom, detected if empty")
+	createClusterCmd.PersistentFlags().StringVar(&cpuModel, "cpu-model", "", "CPU model, implies --cpu-mode custom")
+	createClusterCmd.PersistentFlags().BoolVar(&wait, "wait", false, "wait until all instances have an address, answer on ssh and finished cloud-init")
+	createClusterCmd.PersistentFlags().DurationVar(&waitTime, "wait-timeout", 10*time.Minute, "how long --wait waits per instance")
+	createClusterCmd.PersistentFlags().StringArrayVar(&userData, "user-data", nil, "cloud-init user-data, or an Ignition config for Ignition images, merged into the generated config as [controller=|worker=]<file>, applies to all roles without a role prefix, rendered as a Go template with .Name, .Hostname, .Role, .Index, .Address, .ClusterName, .Suffix, .Peers, .Controllers and .Workers")
+	createClusterCmd.PersistentFlags().BoolVar(&staticIP, "static-ip", true, "configure instances with addresses allocated from the network subnet, DHCP if false")
+	createClusterCmd.PersistentFlags().StringVar(&guestUser, "user", "", "login created on the instances, defaults to the user of the image distro")
+	createClusterCmd.PersistentFlags().StringVar(&password, "password", string(instance.PasswordRandom), "password policy of the user: random (see gokvm credentials), hashed or disabled")
+	createClusterCmd.PersistentFlags().StringVar(&passwdHash, "password-hash", "", "crypt(3) password hash for --password hashed")
+	createClusterCmd.PersistentFlags().BoolVar(&rootLogin, "root-login", false, "allow root to log in with the ssh key")
+	createClusterCmd.PersistentFlags().BoolVar(&sshPwAuth, "ssh-password-auth", false, "allow ssh logins with the password")
+	createClusterCmd.PersistentFlags().StringArrayVar(&domainTmpl, "domain-template", nil, "domain XML template as [controller=|worker=]<file>, applies to all roles without a role prefix")
 
 }
 
@@ -92,17 +121,73 @@ func createCluster() error {
 	if err != nil {
 		return err
 	}
+	// ssh and ssh-config use the private key next to the public one.
+	var sshKey string
+	if privKeyPath := strings.TrimSuffix(pubKeyPath, ".pub"); privKeyPath != pubKeyPath {
+		if _, err := os.Stat(privKeyPath); err == nil {
+			if sshKey, err = filepath.Abs(privKeyPath); err != nil {
+				return err
+			}
+		}
+	}
 
 	memBytes, err := bytefmt.ToBytes(memory)
 	if err != nil {
 		return err
 	}
+	switch cpuMode {
+	case "":
+	case instance.CPUModeHostModel, instance.CPUModeHostPassthrough:
+		if cpuModel != "" {
+			return fmt.Errorf("--cpu-model needs --cpu-mode custom, not %s", cpuMode)
+		}
+	case instance.CPUModeCustom:
+		if cpuModel == "" {
+			return fmt.Errorf("--cpu-model is required with --cpu-mode custom")
+		}
+	default:
+		return fmt.Errorf("invalid cpu mode %q", cpuMode)
+	}
+	credentials := instance.Credentials{
+		Password:        instance.PasswordPolicy(password),
+		PasswordHash:    passwdHash,
+		RootLogin:       rootLogin,
+		SSHPasswordAuth: sshPwAuth,
+	}
+	if err := credentials.Validate(); err != nil {
+		return err
+	}
+	domainTemplates, err := parseRoleFiles(domainTmpl)
+	if err != nil {
+		return err
+	}
+	userDataFiles, err := parseRoleFiles(userData)
+	if err != nil {
+		return err
+	}
+	for _, dataDisk := range dataDisks {
+		if _, err := bytefmt.ToBytes(dataDisk); err != nil {
+			return fmt.Errorf("invalid data disk size %q: %s", dataDisk, err)
+		}
+	}
+	l, err := connectCreate()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	var networks []instance.NetworkAttachment
+	for _, nw := range nws {
+		attachment, err := parseNetworkAttachment(nw)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, attachment)
+	}
 
 	cl := cluster.Cluster{
-		Name: name,
-		Network: network.Network{
-			Name: nw,
-		},
+		Name:     name,
+		Networks: networks,
 		Image: image.Image{
 			Name: img,
 		},
@@ -110,17 +195,74 @@ func createCluster() error {
 		Worker:     worker,
 		Controller: controller,
 		PublicKey:  string(f),
+		SSHKey:     sshKey,
 		Resources: instance.Resources{
-			Memory: memBytes,
-			CPU:    cpu,
-			Disk:   disk,
+			Memory:    memBytes,
+			CPU:       cpu,
+			Disk:      disk,
+			DataDisks: dataDisks,
+		},
+		Platform: instance.Platform{
+			Emulator: emulator,
+			Machine:  machine,
+			CPUMode:  cpuMode,
+			CPUModel: cpuModel,
+		},
+		DomainTemplates: domainTemplates,
+		UserData:        userDataFiles,
+		StaticIP:        staticIP,
+		User:            guestUser,
+		Credentials:     credentials,
+	}
+	if err := cl.Create(l); err != nil {
+		return err
+	}
+	if wait && !dryRun {
+		return cl.Wait(l, waitTime)
+	}
+	return nil
+}
+
+// parseNetworkAttachment parses a --network value of the form
+// name[,mac=<mac>][,model=<model>].
+func parseNetworkAttachment(value string) (instance.NetworkAttachment, error) {
+	parts := strings.Split(value, ",")
+	attachment := instance.NetworkAttachment{
+		Network: network.Network{
+			Name: parts[0],
 		},
 	}
-	return cl.Create()
+	if attachment.Network.Name == "" {
+		return attachment, fmt.Errorf("network name missing in %q", value)
+	}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return attachment, fmt.Errorf("invalid network option %q", part)
+		}
+		switch kv[0] {
+		case "mac":
+			mac, err := net.ParseMAC(kv[1])
+			if err != nil {
+				return attachment, err
+			}
+			attachment.MAC = mac.String()
+		case "model":
+			attachment.Model = kv[1]
+		default:
+			return attachment, fmt.Errorf("unknown network option %q", kv[0])
+		}
+	}
+	return attachment, nil
 }
 
 func listCluster() error {
-	clusters, err := cluster.List()
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	clusters, err := cluster.List(l)
 	if err != nil {
 		return err
 	}
@@ -132,8 +274,37 @@ func deleteCluster() error {
 	if name == "" {
 		log.Fatal("Name is required")
 	}
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
 	cl := cluster.Cluster{
 		Name: name,
 	}
-	return cl.Delete()
+	return cl.Delete(l)
+}
+
+// parseRoleFiles parses repeated flag values of the form [role=]<file>
+// into files per role, the empty role is used for values without prefix.
+func parseRoleFiles(values []string) (map[instance.Role]string, error) {
+	files := map[instance.Role]string{}
+	for _, value := range values {
+		var role instance.Role
+		file := value
+		if kv := strings.SplitN(value, "=", 2); len(kv) == 2 {
+			switch instance.Role(kv[0]) {
+			case instance.Controller, instance.Worker:
+				role, file = instance.Role(kv[0]), kv[1]
+			}
+		}
+		if _, ok := files[role]; ok {
+			return nil, fmt.Errorf("%q: file for role %q given twice", value, role)
+		}
+		if _, err := os.Stat(file); err != nil {
+			return nil, err
+		}
+		files[role] = file
+	}
+	return files, nil
 }
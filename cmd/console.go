@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/instance"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	escapeSequence string
+	forceConsole   bool
+)
+
+func init() {
+	consoleCmd.Flags().StringVarP(&escapeSequence, "escape", "e", "^]", "character detaching from the console, as ^<char>")
+	consoleCmd.Flags().BoolVarP(&forceConsole, "force", "f", false, "disconnect an existing console session")
+}
+
+var consoleCmd = &cobra.Command{
+	Use:   "console",
+	Short: "attaches to the serial console of an instance",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := lifecycleInstance(console); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func console(l backend.Backend, inst *instance.Instance) error {
+	escape, err := parseEscape(escapeSequence)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Connected to %s (escape character is %s)\r\n", inst.Name, escapeSequence)
+	stdin := int(os.Stdin.Fd())
+	if terminal.IsTerminal(stdin) {
+		state, err := terminal.MakeRaw(stdin)
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(stdin, state)
+	}
+	return inst.Console(l, os.Stdin, os.Stdout, escape, forceConsole)
+}
+
+// parseEscape turns ^<char> into the matching control character, a single
+// character is used as is.
+func parseEscape(sequence string) (byte, error) {
+	switch {
+	case len(sequence) == 1:
+		return sequence[0], nil
+	case len(sequence) == 2 && sequence[0] == '^' && sequence[1] >= '@' && sequence[1] <= '_':
+		return sequence[1] & 0x1f, nil
+	}
+	return 0, fmt.Errorf("invalid escape sequence %q", sequence)
+}
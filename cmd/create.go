@@ -2,11 +2,17 @@ package cmd
 
 import (
 	"errors"
+	"os"
 
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/backend/dryrun"
 	"github.com/spf13/cobra"
 )
 
+var dryRun bool
+
 func init() {
+	createCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "print the generated XML and cloud-init without changing anything")
 	createCmd.AddCommand(createNetworkCmd)
 	createCmd.AddCommand(createImageCmd)
 	createCmd.AddCommand(createClusterCmd)
@@ -27,3 +33,16 @@ var createCmd = &cobra.Command{
 		return nil
 	},
 }
+
+// connectCreate connects like connect, with --dry-run the returned backend
+// only prints the changes.
+func connectCreate() (backend.Backend, error) {
+	l, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return dryrun.New(l, os.Stdout), nil
+	}
+	return l, nil
+}
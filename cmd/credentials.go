@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/michaelhenkel/gokvm/instance"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var credentialsCmd = &cobra.Command{
+	Use:   "credentials [instance]",
+	Short: "shows the generated passwords of a cluster",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := showCredentials(args); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func showCredentials(args []string) error {
+	if name == "" {
+		log.Fatal("Name is required")
+	}
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	passwords, err := instance.ListPasswords(l, name)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		instance.RenderPasswords(passwords)
+		return nil
+	}
+	for _, password := range passwords {
+		if password.Instance == args[0] {
+			fmt.Println(password.Password)
+			return nil
+		}
+	}
+	return fmt.Errorf("no generated password for instance %s in cluster %s", args[0], name)
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/instance"
+	"github.com/spf13/cobra"
+)
+
+var (
+	execStdin   bool
+	execTimeout time.Duration
+)
+
+func init() {
+	execCmd.Flags().BoolVarP(&execStdin, "stdin", "i", false, "pass stdin to the command")
+	execCmd.Flags().DurationVarP(&execTimeout, "timeout", "t", instance.ExecTimeout, "time to wait for the command to exit")
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec <instance> -- <command> [args...]",
+	Short: "runs a command in an instance through the guest agent",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if cmd.ArgsLenAtDash() != 1 || len(args) < 2 {
+			return errors.New("requires an instance and a command after --")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode, err := execInstance(args[0], args[1:])
+		if err != nil {
+			panic(err)
+		}
+		os.Exit(exitCode)
+	},
+}
+
+var cpCmd = &cobra.Command{
+	Use:   "cp <src> <dst>",
+	Short: "copies a file from or to an instance through the guest agent, the instance side is given as <instance>:<path>",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := cpInstance(args[0], args[1]); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func execInstance(instanceName string, command []string) (int, error) {
+	var stdin []byte
+	if execStdin {
+		var err error
+		if stdin, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return 0, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+	var result *instance.ExecResult
+	err := withInstance(instanceName, func(l backend.Backend, inst *instance.Instance) error {
+		var err error
+		result, err = inst.Exec(ctx, l, command, stdin)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	os.Stdout.Write(result.Stdout)
+	os.Stderr.Write(result.Stderr)
+	return result.ExitCode, nil
+}
+
+func cpInstance(src, dst string) error {
+	srcInstance, srcPath := splitInstancePath(src)
+	dstInstance, dstPath := splitInstancePath(dst)
+	switch {
+	case srcInstance != "" && dstInstance == "":
+		f, err := os.Create(dstPath)
+		if err != nil {
+			return err
+		}
+		err = withInstance(srcInstance, func(l backend.Backend, inst *instance.Instance) error {
+			return inst.CopyFrom(l, srcPath, f)
+		})
+		if cerr := f.Close(); err == nil && cerr != nil {
+			return fmt.Errorf("cannot write %s: %s", dstPath, cerr)
+		}
+		return err
+	case srcInstance == "" && dstInstance != "":
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return withInstance(dstInstance, func(l backend.Backend, inst *instance.Instance) error {
+			return inst.CopyTo(l, f, dstPath)
+		})
+	}
+	return fmt.Errorf("exactly one of %s and %s must be <instance>:<path>", src, dst)
+}
+
+// splitInstancePath splits <instance>:<path>, a local path returns an
+// empty instance name.
+func splitInstancePath(arg string) (string, string) {
+	idx := strings.Index(arg, ":")
+	if idx <= 0 || strings.Contains(arg[:idx], "/") {
+		return "", arg
+	}
+	return arg[:idx], arg[idx+1:]
+}
@@ -1,8 +1,12 @@
 package cmd
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/spf13/cobra"
 
+	"github.com/michaelhenkel/gokvm/distro"
 	"github.com/michaelhenkel/gokvm/image"
 
 	log "github.com/sirupsen/logrus"
@@ -14,19 +18,35 @@ var (
 	path         string
 	pool         string
 	locationType string
+	imageDistro  string
+	seedFormat   string
 )
 
 func init() {
-	cobra.OnInitialize(initImageConfig)
-	createImageCmd.PersistentFlags().StringVarP(&url, "url", "u", "", "")
-	createImageCmd.PersistentFlags().StringVarP(&md5url, "md5url", "m", "", "")
+	imageCmd.AddCommand(imageCatalogCmd)
+	createImageCmd.PersistentFlags().StringVarP(&url, "url", "u", "", "image URL or path, the catalog entry called like the image or the default image if empty")
+	createImageCmd.PersistentFlags().StringVarP(&md5url, "md5url", "m", "", "checksum file URL or path listing the image (MD5SUMS, SHA256SUMS, ...), or the image digest as [<algorithm>:]<hex>")
 	createImageCmd.PersistentFlags().StringVarP(&path, "path", "p", "", "")
 	createImageCmd.PersistentFlags().StringVarP(&locationType, "locationtype", "l", "", "")
 	createImageCmd.PersistentFlags().StringVarP(&pool, "pool", "s", "", "")
+	createImageCmd.PersistentFlags().StringVar(&imageDistro, "distro", "", fmt.Sprintf("distro profile as <family>[-<version>], one of %s, guessed from name and url if empty", strings.Join(distro.Families(), ", ")))
+	createImageCmd.PersistentFlags().StringVar(&seedFormat, "seed-format", "", fmt.Sprintf("cloud-init seed layout of instances, %s or %s, %s if empty", image.NoCloud, image.ConfigDrive, image.NoCloud))
 }
 
-func initImageConfig() {
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "image catalog",
+}
 
+var imageCatalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "lists the images that can be created by name",
+	Long:  `The built-in catalog is extended by catalog.yaml in the gokvm config directory, entries there replace built-in ones of the same name.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := listImageCatalog(); err != nil {
+			panic(err)
+		}
+	},
 }
 
 var createImageCmd = &cobra.Command{
@@ -72,28 +92,77 @@ func createImage() error {
 	if path == "" {
 		path = "/var/lib/libvirt/images"
 	}
-	if url == "" {
-		url = "https://cloud-images.ubuntu.com/releases/focal/release-20210315/ubuntu-20.04-server-cloudimg-amd64.img"
-		url = "http://localhost:8000/ubuntu-20.04-server-cloudimg-amd64.img"
-	}
 	if locationType == "" {
 		locationType = string(image.URL)
 	}
+	if imageDistro != "" {
+		if _, err := distro.Lookup(imageDistro); err != nil {
+			return err
+		}
+	}
+	seed, err := image.ParseSeedFormat(seedFormat)
+	if err != nil {
+		return err
+	}
 	i := image.Image{
 		Name:              name,
 		Pool:              pool,
 		Path:              path,
 		ImageLocationType: image.ImageLocationType(locationType),
 		ImageLocation:     url,
+		Checksum:          md5url,
+		Distro:            imageDistro,
+		SeedFormat:        seed,
+	}
+	if url == "" {
+		entry, err := image.LookupCatalog(name)
+		if err != nil {
+			return err
+		}
+		defaultImage := image.DefaultImage()
+		if entry != nil {
+			defaultImage = entry.Image()
+		}
+		i.ImageLocationType = image.URL
+		i.ImageLocation = defaultImage.ImageLocation
+		if i.Checksum == "" {
+			i.Checksum = defaultImage.Checksum
+		}
+		if i.Distro == "" {
+			i.Distro = defaultImage.Distro
+		}
+		if seedFormat == "" && defaultImage.SeedFormat != "" {
+			i.SeedFormat = defaultImage.SeedFormat
+		}
+		i.Format = defaultImage.Format
+	}
+	l, err := connectCreate()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return i.Create(l)
+}
+
+func listImageCatalog() error {
+	entries, err := image.Catalog()
+	if err != nil {
+		return err
 	}
-	return i.Create()
+	image.RenderCatalog(entries)
+	return nil
 }
 
 func listImage() error {
 	if pool == "" {
 		pool = "gokvm"
 	}
-	images, err := image.List(pool)
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	images, err := image.List(l, pool)
 	if err != nil {
 		return err
 	}
@@ -108,9 +177,14 @@ func deleteImage() error {
 	if pool == "" {
 		pool = "gokvm"
 	}
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
 	i := image.Image{
 		Name: name,
 		Pool: pool,
 	}
-	return i.Delete()
+	return i.Delete(l)
 }
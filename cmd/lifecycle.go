@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/cluster"
+	"github.com/michaelhenkel/gokvm/instance"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	stopTimeout time.Duration
+)
+
+var startCmd = newLifecycleCmd("start", "starts a cluster/instance",
+	func(l backend.Backend, cl *cluster.Cluster) error { return cl.Start(l) },
+	func(l backend.Backend, inst *instance.Instance) error { return inst.Start(l) })
+
+var stopCmd = newLifecycleCmd("stop", "shuts down a cluster/instance, destroying it after --timeout",
+	func(l backend.Backend, cl *cluster.Cluster) error { return cl.Stop(l, stopTimeout) },
+	func(l backend.Backend, inst *instance.Instance) error { return inst.Stop(l, stopTimeout) })
+
+var rebootCmd = newLifecycleCmd("reboot", "reboots a cluster/instance",
+	func(l backend.Backend, cl *cluster.Cluster) error { return cl.Reboot(l) },
+	func(l backend.Backend, inst *instance.Instance) error { return inst.Reboot(l) })
+
+var suspendCmd = newLifecycleCmd("suspend", "suspends a cluster/instance",
+	func(l backend.Backend, cl *cluster.Cluster) error { return cl.Suspend(l) },
+	func(l backend.Backend, inst *instance.Instance) error { return inst.Suspend(l) })
+
+var resumeCmd = newLifecycleCmd("resume", "resumes a suspended cluster/instance",
+	func(l backend.Backend, cl *cluster.Cluster) error { return cl.Resume(l) },
+	func(l backend.Backend, inst *instance.Instance) error { return inst.Resume(l) })
+
+func init() {
+	stopCmd.PersistentFlags().DurationVarP(&stopTimeout, "timeout", "t", 2*time.Minute, "time to wait for a graceful shutdown")
+}
+
+// newLifecycleCmd builds a command with a cluster and an instance
+// subcommand, both acting on the --name'd object.
+func newLifecycleCmd(use string, short string, clusterFn func(backend.Backend, *cluster.Cluster) error, instanceFn func(backend.Backend, *instance.Instance) error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   string(CLUSTER),
+		Short: fmt.Sprintf("%s all instances of a cluster", use),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := lifecycleCluster(clusterFn); err != nil {
+				panic(err)
+			}
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   string(INSTANCE),
+		Short: fmt.Sprintf("%s an instance", use),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := lifecycleInstance(instanceFn); err != nil {
+				panic(err)
+			}
+		},
+	})
+	return cmd
+}
+
+func lifecycleCluster(fn func(backend.Backend, *cluster.Cluster) error) error {
+	if name == "" {
+		log.Fatal("Name is required")
+	}
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	cl := &cluster.Cluster{
+		Name: name,
+	}
+	return fn(l, cl)
+}
+
+func lifecycleInstance(fn func(backend.Backend, *instance.Instance) error) error {
+	if name == "" {
+		log.Fatal("Name is required")
+	}
+	return withInstance(name, fn)
+}
+
+func withInstance(instanceName string, fn func(backend.Backend, *instance.Instance) error) error {
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	inst, err := instance.Get(l, instanceName, "")
+	if err != nil {
+		return err
+	}
+	if inst == nil {
+		return fmt.Errorf("instance %s not found", instanceName)
+	}
+	return fn(l, inst)
+}
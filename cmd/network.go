@@ -76,7 +76,12 @@ func createNetwork() error {
 		Gateway:   gatewayIP,
 		Type:      network.NetworkType(networkType),
 	}
-	if err := newNetwork.Create(); err != nil {
+	l, err := connectCreate()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := newNetwork.Create(l); err != nil {
 		return err
 	}
 	return nil
@@ -125,7 +130,12 @@ var listNetworkCmd = &cobra.Command{
 }
 
 func listNetwork() error {
-	networks, err := network.List()
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	networks, err := network.List(l)
 	if err != nil {
 		return err
 	}
@@ -148,10 +158,15 @@ func deleteNetwork() error {
 	if name == "" {
 		log.Fatal("Name is required")
 	}
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
 	newNetwork := &network.Network{
 		Name: name,
 	}
-	if err := newNetwork.Delete(); err != nil {
+	if err := newNetwork.Delete(l); err != nil {
 		return err
 	}
 	return nil
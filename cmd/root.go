@@ -1,19 +1,30 @@
 package cmd
 
 import (
+	"os"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/config"
+	"github.com/michaelhenkel/gokvm/qemu"
 	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type Commands string
 
 const (
-	NETWORK Commands = "network"
-	CLUSTER Commands = "cluster"
-	IMAGE   Commands = "image"
+	NETWORK  Commands = "network"
+	CLUSTER  Commands = "cluster"
+	IMAGE    Commands = "image"
+	INSTANCE Commands = "instance"
 )
 
 var (
 	name    string
+	uri     string
+	cfgFile string
+	cfg     *config.Config
 	rootCmd = &cobra.Command{
 		Use:   "gokvm",
 		Short: "",
@@ -28,12 +39,44 @@ func Execute() error {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVarP(&name, "name", "n", "", "")
+	rootCmd.PersistentFlags().StringVar(&uri, "connect", "", "libvirt connection URI (default $GOKVM_URI or qemu:///system)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default $HOME/.gokvm/config.yaml)")
 
 	rootCmd.AddCommand(createCmd)
 	rootCmd.AddCommand(deleteCmd)
 	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(startCmd)
+	rootCmd.AddCommand(stopCmd)
+	rootCmd.AddCommand(rebootCmd)
+	rootCmd.AddCommand(suspendCmd)
+	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(snapshotCmd)
+	rootCmd.AddCommand(consoleCmd)
+	rootCmd.AddCommand(sshCmd)
+	rootCmd.AddCommand(sshConfigCmd)
+	rootCmd.AddCommand(execCmd)
+	rootCmd.AddCommand(cpCmd)
+	rootCmd.AddCommand(credentialsCmd)
+	rootCmd.AddCommand(imageCmd)
 }
 
 func initConfig() {
+	c, err := config.Load(cfgFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg = c
+}
 
+// connect opens the libvirt connection shared by a command. The URI is
+// taken from --connect, then GOKVM_URI, then the config file.
+func connect() (backend.Backend, error) {
+	connectURI := uri
+	if connectURI == "" {
+		connectURI = os.Getenv("GOKVM_URI")
+	}
+	if connectURI == "" {
+		connectURI = cfg.URI
+	}
+	return qemu.Connect(connectURI)
 }
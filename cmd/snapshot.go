@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/cluster"
+	"github.com/michaelhenkel/gokvm/instance"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	snapshotName string
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "creates/lists/reverts/deletes cluster and instance snapshots",
+}
+
+func init() {
+	snapshotCmd.PersistentFlags().StringVarP(&snapshotName, "snapshot", "s", "", "snapshot name")
+
+	snapshotCmd.AddCommand(newSnapshotCmd("create", "creates a snapshot", true,
+		func(l backend.Backend, cl *cluster.Cluster) error { return cl.CreateSnapshot(l, snapshotName) },
+		func(l backend.Backend, inst *instance.Instance) error {
+			return inst.CreateSnapshot(l, snapshotName, false)
+		}))
+	snapshotCmd.AddCommand(newSnapshotCmd("list", "lists snapshots", false,
+		listClusterSnapshots,
+		listInstanceSnapshots))
+	snapshotCmd.AddCommand(newSnapshotCmd("revert", "reverts to a snapshot", true,
+		func(l backend.Backend, cl *cluster.Cluster) error { return cl.RevertSnapshot(l, snapshotName) },
+		func(l backend.Backend, inst *instance.Instance) error { return inst.RevertSnapshot(l, snapshotName) }))
+	snapshotCmd.AddCommand(newSnapshotCmd("delete", "deletes a snapshot", true,
+		func(l backend.Backend, cl *cluster.Cluster) error { return cl.DeleteSnapshot(l, snapshotName) },
+		func(l backend.Backend, inst *instance.Instance) error { return inst.DeleteSnapshot(l, snapshotName) }))
+}
+
+// newSnapshotCmd builds a snapshot subcommand with cluster and instance
+// variants, reusing the lifecycle command plumbing.
+func newSnapshotCmd(use string, short string, needsSnapshot bool, clusterFn func(backend.Backend, *cluster.Cluster) error, instanceFn func(backend.Backend, *instance.Instance) error) *cobra.Command {
+	cmd := newLifecycleCmd(use, short, clusterFn, instanceFn)
+	for _, sub := range cmd.Commands() {
+		sub.Short = fmt.Sprintf("%s for the named %s", short, sub.Use)
+	}
+	if needsSnapshot {
+		cmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+			if snapshotName == "" {
+				log.Fatal("Snapshot name is required")
+			}
+		}
+	}
+	return cmd
+}
+
+func listClusterSnapshots(l backend.Backend, cl *cluster.Cluster) error {
+	snapshots, err := cl.ListSnapshots(l)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		fmt.Printf("cluster %s has no snapshots\n", cl.Name)
+		return nil
+	}
+	cluster.RenderSnapshots(snapshots)
+	return nil
+}
+
+func listInstanceSnapshots(l backend.Backend, inst *instance.Instance) error {
+	snapshots, err := inst.ListSnapshots(l)
+	if err != nil {
+		return err
+	}
+	instance.RenderSnapshots(snapshots)
+	return nil
+}
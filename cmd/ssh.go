@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/michaelhenkel/gokvm/instance"
+	"github.com/spf13/cobra"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var sshClusterName string
+
+func init() {
+	sshConfigCmd.Flags().StringVar(&sshClusterName, "cluster", "", "only instances of this cluster")
+}
+
+var sshCmd = &cobra.Command{
+	Use:   "ssh <instance> [-- command]",
+	Short: "logs into an instance or runs a command on it",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := sshInstance(cmd, args); err != nil {
+			panic(err)
+		}
+	},
+}
+
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config",
+	Short: "prints ssh_config Host entries for the instances",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := sshConfig(); err != nil {
+			panic(err)
+		}
+	},
+}
+
+func sshInstance(cmd *cobra.Command, args []string) error {
+	instanceName := name
+	command := args
+	if dash := cmd.ArgsLenAtDash(); len(args) > 0 && dash != 0 {
+		instanceName = args[0]
+		command = args[1:]
+	}
+	if instanceName == "" {
+		log.Fatal("Name is required")
+	}
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	inst, err := instance.Get(l, instanceName, "")
+	l.Close()
+	if err != nil {
+		return err
+	}
+	if inst == nil {
+		return fmt.Errorf("instance %s not found", instanceName)
+	}
+	sshArgs, err := inst.SSHArgs(command)
+	if err != nil {
+		return err
+	}
+	sshPath, err := exec.LookPath(sshArgs[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(sshPath, sshArgs, os.Environ())
+}
+
+func sshConfig() error {
+	l, err := connect()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	instances, err := instance.List(l, sshClusterName)
+	if err != nil {
+		return err
+	}
+	return instance.WriteSSHConfig(os.Stdout, instances)
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings read from the gokvm config file.
+type Config struct {
+	URI string `yaml:"uri"`
+}
+
+// Dir returns the directory gokvm keeps its configuration in.
+func Dir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gokvm"), nil
+}
+
+// HostDir returns the directory in Dir gokvm keeps what it knows about
+// the host behind the connection uri in.
+func HostDir(uri string) (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "hosts", url.PathEscape(uri)), nil
+}
+
+// Load reads the config file at path. An empty path selects config.yaml
+// in Dir. A missing file is not an error and yields an empty Config.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		dir, err := Dir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "config.yaml")
+	}
+	cfg := &Config{}
+	f, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(f, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,213 @@
+// Package distro describes how guests of the supported distributions are
+// provisioned.
+package distro
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DNSMethod is how the DNS server is configured in the guest.
+type DNSMethod string
+
+const (
+	// DNSResolved writes /etc/systemd/resolved.conf and restarts
+	// systemd-resolved.
+	DNSResolved DNSMethod = "resolved"
+	// DNSResolvConf lets the cloud-init resolv_conf module write
+	// /etc/resolv.conf.
+	DNSResolvConf DNSMethod = "resolv_conf"
+	// DNSFile writes /etc/resolv.conf as a plain file.
+	DNSFile DNSMethod = "file"
+)
+
+// Provisioner is how the guest reads its configuration on first boot.
+type Provisioner string
+
+const (
+	// CloudInit reads a seed disk.
+	CloudInit Provisioner = "cloud-init"
+	// Ignition reads a config passed through QEMU fw_cfg.
+	Ignition Provisioner = "ignition"
+)
+
+// InitSystem is the service manager of the guest.
+type InitSystem string
+
+const (
+	Systemd InitSystem = "systemd"
+	OpenRC  InitSystem = "openrc"
+)
+
+// Default is the profile of images without a known distribution, it
+// matches image.DefaultImage.
+const Default = "ubuntu-20.04"
+
+// Profile is a distribution release.
+type Profile struct {
+	// Family is the distribution, e.g. debian.
+	Family  string
+	Version string
+	// DefaultUser is the login created if no user is given.
+	DefaultUser string
+	Shell       string
+	DNS         DNSMethod
+	Init        InitSystem
+	Provisioner Provisioner
+	// AgentPackage is the package and service of the QEMU guest agent,
+	// empty if the image ships the agent or its package manager cannot
+	// install it.
+	AgentPackage string
+	// OSInfoID identifies the release in the libosinfo database, it is
+	// placed in the domain metadata if set.
+	OSInfoID string
+}
+
+// Name returns family-version.
+func (p Profile) Name() string {
+	return p.Family + "-" + p.Version
+}
+
+// StartService returns the commands enabling and starting service.
+func (p Profile) StartService(service string) []string {
+	if p.Init == OpenRC {
+		return []string{
+			"rc-update add " + service,
+			"rc-service " + service + " start",
+		}
+	}
+	return []string{"systemctl enable --now " + service}
+}
+
+type family struct {
+	profile Profile
+	// osInfo is the libosinfo id with %s for the version, empty if
+	// libosinfo does not know the family.
+	osInfo string
+	// keywords identify the family in image names and URLs.
+	keywords []string
+}
+
+var families = map[string]family{
+	"ubuntu": {
+		profile:  Profile{Version: "20.04", DefaultUser: "ubuntu", DNS: DNSResolved, AgentPackage: "qemu-guest-agent"},
+		osInfo:   "http://ubuntu.com/ubuntu/%s",
+		keywords: []string{"ubuntu"},
+	},
+	"debian": {
+		profile:  Profile{Version: "12", DefaultUser: "debian", DNS: DNSFile, AgentPackage: "qemu-guest-agent"},
+		osInfo:   "http://debian.org/debian/%s",
+		keywords: []string{"debian"},
+	},
+	"fedora": {
+		profile:  Profile{Version: "39", DefaultUser: "fedora", DNS: DNSResolved, AgentPackage: "qemu-guest-agent"},
+		osInfo:   "http://fedoraproject.org/fedora/%s",
+		keywords: []string{"fedora"},
+	},
+	"centos-stream": {
+		profile:  Profile{Version: "9", DefaultUser: "cloud-user", DNS: DNSResolvConf, AgentPackage: "qemu-guest-agent"},
+		osInfo:   "http://centos.org/centos-stream/%s",
+		keywords: []string{"centos"},
+	},
+	"alpine": {
+		profile:  Profile{Version: "3.18", DefaultUser: "alpine", Shell: "/bin/ash", DNS: DNSResolvConf, Init: OpenRC, AgentPackage: "qemu-guest-agent"},
+		osInfo:   "http://alpinelinux.org/alpinelinux/%s",
+		keywords: []string{"alpine"},
+	},
+	// CoreOS style images take Ignition and get their addresses by DHCP,
+	// static addresses come from the DHCP reservations. They have no
+	// package manager to install the guest agent with.
+	"fedora-coreos": {
+		profile:  Profile{Version: "stable", DefaultUser: "core", Provisioner: Ignition},
+		osInfo:   "http://fedoraproject.org/coreos/%s",
+		keywords: []string{"fedora-coreos", "coreos"},
+	},
+	"flatcar": {
+		profile:  Profile{Version: "stable", DefaultUser: "core", Provisioner: Ignition},
+		keywords: []string{"flatcar"},
+	},
+	"opensuse": {
+		profile:  Profile{Version: "15.5", DefaultUser: "opensuse", DNS: DNSResolvConf, AgentPackage: "qemu-guest-agent"},
+		osInfo:   "http://opensuse.org/opensuse/%s",
+		keywords: []string{"opensuse", "suse", "leap"},
+	},
+}
+
+// Lookup returns the profile for name, which is a family optionally
+// followed by -version, e.g. debian or debian-12.
+func Lookup(name string) (Profile, error) {
+	name = strings.ToLower(name)
+	// the longest family wins, fedora-coreos is no fedora version
+	var match, version string
+	for familyName, f := range families {
+		if len(familyName) <= len(match) {
+			continue
+		}
+		switch {
+		case name == familyName:
+			match, version = familyName, f.profile.Version
+		case strings.HasPrefix(name, familyName+"-"):
+			match, version = familyName, strings.TrimPrefix(name, familyName+"-")
+		}
+	}
+	if match == "" {
+		return Profile{}, fmt.Errorf("unknown distro %q, known are %s", name, strings.Join(Families(), ", "))
+	}
+	if version == "" {
+		return Profile{}, fmt.Errorf("missing version in distro %q", name)
+	}
+	return families[match].build(match, version), nil
+}
+
+// Detect guesses the family from an image name or URL, the default
+// profile is returned if nothing matches. The longest matching keyword
+// wins.
+func Detect(hints ...string) Profile {
+	for _, hint := range hints {
+		hint = strings.ToLower(hint)
+		var match, matchKeyword string
+		for familyName, f := range families {
+			for _, keyword := range f.keywords {
+				if len(keyword) > len(matchKeyword) && strings.Contains(hint, keyword) {
+					match, matchKeyword = familyName, keyword
+				}
+			}
+		}
+		if match != "" {
+			f := families[match]
+			return f.build(match, f.profile.Version)
+		}
+	}
+	p, _ := Lookup(Default)
+	return p
+}
+
+// Families returns the known families sorted by name.
+func Families() []string {
+	var names []string
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f family) build(familyName, version string) Profile {
+	p := f.profile
+	p.Family = familyName
+	p.Version = version
+	if f.osInfo != "" {
+		p.OSInfoID = fmt.Sprintf(f.osInfo, version)
+	}
+	if p.Shell == "" {
+		p.Shell = "/bin/bash"
+	}
+	if p.Init == "" {
+		p.Init = Systemd
+	}
+	if p.Provisioner == "" {
+		p.Provisioner = CloudInit
+	}
+	return p
+}
@@ -3,7 +3,7 @@ module github.com/michaelhenkel/gokvm
 go 1.16
 
 require (
-	code.cloudfoundry.org/bytefmt v0.0.0-20210524144015-27119551aaea // indirect
+	code.cloudfoundry.org/bytefmt v0.0.0-20210524144015-27119551aaea
 	github.com/digitalocean/go-libvirt v0.0.0-20210524223541-696696fc24e0
 	github.com/google/uuid v1.2.0
 	github.com/jedib0t/go-pretty/v6 v6.2.2
@@ -12,6 +12,7 @@ require (
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/cobra v1.1.3
 	github.com/zchee/go-qcow2 v0.0.0-20170102190316-9a991fd172f0 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 	libvirt.org/libvirt-go v7.4.0+incompatible
 	libvirt.org/libvirt-go-xml v7.3.0+incompatible
@@ -0,0 +1,197 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	downloadAttempts   = 5
+	downloadBackoff    = time.Second
+	maxDownloadBackoff = 30 * time.Second
+)
+
+// permanentError is a download error retrying does not fix.
+type permanentError struct {
+	error
+}
+
+// cacheDir returns the directory downloaded images are kept in. A cached
+// image is named by the hash of its URL and checksum, its mtime is the
+// Last-Modified time of the server, a partial download has a .part
+// suffix and its ETag or Last-Modified in a .part.validator file.
+func cacheDir() (string, error) {
+	dir, err := config.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cache", "images"), nil
+}
+
+func cacheKey(url, checksum string) string {
+	sum := sha256.Sum256([]byte(url + "\n" + checksum))
+	return hex.EncodeToString(sum[:])
+}
+
+// download fetches the image into the cache and returns its path. A
+// cached image is revalidated with the server and reused if it is not
+// modified or the server cannot be reached.
+func (i *Image) download() (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	cached := filepath.Join(dir, cacheKey(i.ImageLocation, i.Checksum))
+	// revalidation is not worth retrying, the cached image is used
+	_, statErr := os.Stat(cached)
+	isCached := statErr == nil
+	backoff := downloadBackoff
+	for attempt := 1; ; attempt++ {
+		err = fetch(i.ImageLocation, cached, i.Name)
+		if err == nil {
+			return cached, nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) || attempt == downloadAttempts || isCached {
+			break
+		}
+		log.Warnf("Downloading %s failed, retrying in %s: %s", i.ImageLocation, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxDownloadBackoff {
+			backoff = maxDownloadBackoff
+		}
+	}
+	if _, statErr := os.Stat(cached); statErr == nil {
+		log.Warnf("Using cached image, revalidating %s failed: %s", i.ImageLocation, err)
+		return cached, nil
+	}
+	return "", err
+}
+
+// evict removes the image from the cache, e.g. after it failed
+// verification.
+func (i *Image) evict() error {
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, cacheKey(i.ImageLocation, i.Checksum))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// fetch downloads url to cached. A cached file is revalidated with
+// If-Modified-Since, a partial download is resumed with a Range request
+// that only applies if the file still matches the validator of the
+// partial download.
+func fetch(url, cached, name string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return permanentError{err}
+	}
+	partial := cached + ".part"
+	validatorFile := partial + ".validator"
+	var offset int64
+	if fi, err := os.Stat(cached); err == nil {
+		req.Header.Set("If-Modified-Since", fi.ModTime().UTC().Format(http.TimeFormat))
+	} else if fi, err := os.Stat(partial); err == nil && fi.Size() > 0 {
+		// without validator the partial download cannot be told apart
+		// from a changed file and is started over
+		if validator, err := os.ReadFile(validatorFile); err == nil && len(validator) > 0 {
+			offset = fi.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", string(validator))
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Infof("Using cached image for %s\n", url)
+		return nil
+	case http.StatusPartialContent:
+		log.Infof("Resuming download of %s at %d bytes\n", url, offset)
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		if offset > 0 {
+			log.Infof("%s changed, restarting its download\n", url)
+		}
+		log.Infof("Downloading image from %s\n", url)
+		offset = 0
+		flags |= os.O_TRUNC
+		if err := os.WriteFile(validatorFile, []byte(responseValidator(resp)), 0644); err != nil {
+			return permanentError{err}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial download does not match the file anymore
+		if err := os.Remove(partial); err != nil {
+			return err
+		}
+		return fmt.Errorf("downloading %s: %s", url, resp.Status)
+	default:
+		err := fmt.Errorf("downloading %s: %s", url, resp.Status)
+		if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	out, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return permanentError{err}
+	}
+	defer out.Close()
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	bar := newProgress(name, offset, total)
+	_, err = io.Copy(out, io.TeeReader(resp.Body, bar))
+	bar.done()
+	if err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, cached); err != nil {
+		return permanentError{err}
+	}
+	if err := os.Remove(validatorFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		return os.Chtimes(cached, modified, modified)
+	}
+	return nil
+}
+
+// responseValidator returns what identifies the version of the file in
+// resp for If-Range, the ETag unless it is weak or else Last-Modified.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
@@ -0,0 +1,69 @@
+package image
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchResume(t *testing.T) {
+	content := []byte("the current image content")
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "image", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		partial   string
+		validator string
+		wantRange bool
+	}{
+		{"fresh", "", "", false},
+		{"resumed", "the current", `"v2"`, true},
+		{"changed", "the old", `"v1"`, true},
+		{"no validator", "the current", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cached := filepath.Join(t.TempDir(), "image")
+			if tt.partial != "" {
+				if err := os.WriteFile(cached+".part", []byte(tt.partial), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.validator != "" {
+				if err := os.WriteFile(cached+".part.validator", []byte(tt.validator), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ranges = nil
+			if err := fetch(server.URL, cached, "image"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(cached)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("got %q, want %q", got, content)
+			}
+			if sentRange := strings.Join(ranges, "") != ""; sentRange != tt.wantRange {
+				t.Errorf("got Range headers %q, want a range request %t", ranges, tt.wantRange)
+			}
+			for _, leftover := range []string{cached + ".part", cached + ".part.validator"} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s is left behind", filepath.Base(leftover))
+				}
+			}
+		})
+	}
+}
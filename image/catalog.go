@@ -0,0 +1,132 @@
+package image
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/michaelhenkel/gokvm/config"
+	"github.com/michaelhenkel/gokvm/distro"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed catalog.yaml
+var builtinCatalog []byte
+
+// CatalogEntry is an image that can be created by its name.
+type CatalogEntry struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Checksum is the checksum file or digest of the image, see
+	// Image.Checksum.
+	Checksum string `yaml:"checksum,omitempty"`
+	// Format is the disk format of the image, e.g. qcow2 or raw. The image
+	// is uploaded as is if set, compressed images must leave it empty.
+	Format     string     `yaml:"format,omitempty"`
+	Distro     string     `yaml:"distro,omitempty"`
+	SeedFormat SeedFormat `yaml:"seedFormat,omitempty"`
+}
+
+type catalog struct {
+	Images []CatalogEntry `yaml:"images"`
+}
+
+// Catalog returns the built-in catalog merged with catalog.yaml in
+// config.Dir, sorted by name. User entries replace built-in entries of the
+// same name.
+func Catalog() ([]CatalogEntry, error) {
+	entries := make(map[string]CatalogEntry)
+	if err := loadCatalog(builtinCatalog, "built-in catalog", entries); err != nil {
+		return nil, err
+	}
+	dir, err := config.Dir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "catalog.yaml")
+	userCatalog, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := loadCatalog(userCatalog, path, entries); err != nil {
+			return nil, err
+		}
+	}
+	var list []CatalogEntry
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func loadCatalog(content []byte, source string, entries map[string]CatalogEntry) error {
+	var c catalog
+	if err := yaml.Unmarshal(content, &c); err != nil {
+		return fmt.Errorf("%s: %s", source, err)
+	}
+	for _, entry := range c.Images {
+		if entry.Name == "" || entry.URL == "" {
+			return fmt.Errorf("%s: entry without name or url", source)
+		}
+		if entry.Distro != "" {
+			if _, err := distro.Lookup(entry.Distro); err != nil {
+				return fmt.Errorf("%s: %s: %s", source, entry.Name, err)
+			}
+		}
+		if _, err := ParseSeedFormat(string(entry.SeedFormat)); err != nil {
+			return fmt.Errorf("%s: %s: %s", source, entry.Name, err)
+		}
+		switch entry.Format {
+		case "", FormatQCOW2, FormatRaw, FormatVMDK, FormatVHDX, FormatVDI, FormatVPC:
+		default:
+			return fmt.Errorf("%s: %s: unknown format %q", source, entry.Name, entry.Format)
+		}
+		entries[entry.Name] = entry
+	}
+	return nil
+}
+
+// LookupCatalog returns the catalog entry called name, nil if there is
+// none.
+func LookupCatalog(name string) (*CatalogEntry, error) {
+	entries, err := Catalog()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// Image returns the image of the entry in the default pool.
+func (e CatalogEntry) Image() Image {
+	img := DefaultImage()
+	img.Name = e.Name
+	img.ImageLocation = e.URL
+	img.Checksum = e.Checksum
+	img.Distro = e.Distro
+	img.SeedFormat = e.SeedFormat
+	img.Format = e.Format
+	return img
+}
+
+func RenderCatalog(entries []CatalogEntry) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Name", "Distro", "Format", "URL"})
+	var tableRows []table.Row
+	for _, entry := range entries {
+		tableRows = append(tableRows, table.Row{entry.Name, entry.Distro, entry.Format, entry.URL})
+	}
+	t.AppendRows(tableRows)
+	t.SetStyle(table.StyleLight)
+	t.Render()
+}
@@ -0,0 +1,36 @@
+package image
+
+import "testing"
+
+func TestLoadCatalog(t *testing.T) {
+	entries := make(map[string]CatalogEntry)
+	if err := loadCatalog(builtinCatalog, "built-in catalog", entries); err != nil {
+		t.Fatal(err)
+	}
+	user := []byte(`images:
+- name: ubuntu-22.04
+  url: https://example.com/jammy.raw
+  format: raw
+  distro: ubuntu-22.04
+`)
+	if err := loadCatalog(user, "user catalog", entries); err != nil {
+		t.Fatal(err)
+	}
+	img := entries["ubuntu-22.04"].Image()
+	if img.ImageLocation != "https://example.com/jammy.raw" || img.Format != FormatRaw || img.Distro != "ubuntu-22.04" {
+		t.Errorf("got image %+v, want the user entry", img)
+	}
+	if img := entries["debian-12"].Image(); img.Format != FormatQCOW2 {
+		t.Errorf("got format %q for debian-12, want qcow2", img.Format)
+	}
+
+	for _, bad := range []string{
+		"images:\n- name: x\n",
+		"images:\n- name: x\n  url: https://example.com/x\n  format: iso\n",
+		"images:\n- name: x\n  url: https://example.com/x\n  distro: beos\n",
+	} {
+		if err := loadCatalog([]byte(bad), "bad", make(map[string]CatalogEntry)); err == nil {
+			t.Errorf("loading %q succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// hashes maps the algorithms a checksum can use to the length of their
+// hex digest, a bare digest is identified by its length.
+var hashes = map[string]struct {
+	hexLen int
+	new    func() hash.Hash
+}{
+	"md5":    {32, md5.New},
+	"sha1":   {40, sha1.New},
+	"sha256": {64, sha256.New},
+	"sha512": {128, sha512.New},
+}
+
+// digest is the hash of an image, written as <algorithm>:<hex>.
+type digest struct {
+	algorithm string
+	hex       string
+}
+
+func (d digest) String() string {
+	return d.algorithm + ":" + d.hex
+}
+
+// parseDigest parses [<algorithm>:]<hex>, ok is false if s is no digest.
+func parseDigest(s string) (d digest, ok bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if idx := strings.Index(s, ":"); idx >= 0 {
+		d.algorithm, d.hex = s[:idx], s[idx+1:]
+	} else {
+		d.hex = s
+	}
+	if _, err := hex.DecodeString(d.hex); err != nil || d.hex == "" {
+		return digest{}, false
+	}
+	for algorithm, h := range hashes {
+		if len(d.hex) != h.hexLen {
+			continue
+		}
+		if d.algorithm == "" {
+			d.algorithm = algorithm
+		}
+		if d.algorithm == algorithm {
+			return d, true
+		}
+	}
+	return digest{}, false
+}
+
+// expectedDigest returns the digest the image must have, nil if the image
+// has no checksum. Checksum is a digest or the URL or path of a checksum
+// file listing the image file.
+func (i *Image) expectedDigest() (*digest, error) {
+	if i.Checksum == "" {
+		return nil, nil
+	}
+	if d, ok := parseDigest(i.Checksum); ok {
+		return &d, nil
+	}
+	var content []byte
+	if strings.HasPrefix(i.Checksum, "http://") || strings.HasPrefix(i.Checksum, "https://") {
+		resp, err := http.Get(i.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("checksum file %s: %s", i.Checksum, resp.Status)
+		}
+		if content, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if content, err = os.ReadFile(i.Checksum); err != nil {
+			return nil, err
+		}
+	}
+	filename := path.Base(i.ImageLocation)
+	d, ok := lookupDigest(content, filename)
+	if !ok {
+		return nil, fmt.Errorf("checksum file %s has no digest for %s", i.Checksum, filename)
+	}
+	return &d, nil
+}
+
+// lookupDigest finds filename in a checksum file as written by md5sum and
+// sha256sum, "<hex>  <file>" or "<hex> *<file>", or in the BSD style
+// "SHA256 (<file>) = <hex>".
+func lookupDigest(content []byte, filename string) (digest, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var algorithm, sum, file string
+		if idx := strings.Index(line, " ("); idx > 0 && strings.Contains(line, ") = ") {
+			algorithm = line[:idx]
+			rest := line[idx+2:]
+			end := strings.LastIndex(rest, ") = ")
+			file, sum = rest[:end], rest[end+4:]
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			sum, file = fields[0], strings.TrimPrefix(fields[1], "*")
+		}
+		if path.Base(file) != filename {
+			continue
+		}
+		if algorithm != "" {
+			sum = algorithm + ":" + sum
+		}
+		if d, ok := parseDigest(sum); ok {
+			return d, true
+		}
+	}
+	return digest{}, false
+}
+
+// verify checks that the file at filename has the digest.
+func verify(filename string, expected digest) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := hashes[expected.algorithm].new()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != expected.hex {
+		return fmt.Errorf("checksum mismatch, expected %s, got %s:%s", expected, expected.algorithm, sum)
+	}
+	return nil
+}
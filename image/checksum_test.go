@@ -0,0 +1,130 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	helloMD5    = "5d41402abc4b2a76b9719d911017c592"
+	helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+)
+
+func TestParseDigest(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{helloSHA256, "sha256:" + helloSHA256, true},
+		{"sha256:" + helloSHA256, "sha256:" + helloSHA256, true},
+		{"SHA256:" + strings.ToUpper(helloSHA256), "sha256:" + helloSHA256, true},
+		{" " + helloMD5 + "\n", "md5:" + helloMD5, true},
+		{"md5:" + helloMD5, "md5:" + helloMD5, true},
+		{"sha256:" + helloMD5, "", false},
+		{"crc32:" + helloMD5, "", false},
+		{"https://example.com/SHA256SUMS", "", false},
+		{strings.Repeat("g", 64), "", false},
+		{"abc", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		d, ok := parseDigest(tt.in)
+		if ok != tt.ok || (ok && d.String() != tt.want) {
+			t.Errorf("parseDigest(%q) = %s, %t, want %s, %t", tt.in, d, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLookupDigest(t *testing.T) {
+	gnu := helloMD5 + "  other.img\n" +
+		helloSHA256 + "  image.img\n" +
+		helloSHA256 + " *binary.img\n" +
+		helloSHA256 + "  dir/nested.img\n"
+	bsd := "-----BEGIN PGP SIGNED MESSAGE-----\n" +
+		"Hash: SHA256\n\n" +
+		"# image.qcow2: 12345 bytes\n" +
+		"SHA256 (image.qcow2) = " + helloSHA256 + "\n" +
+		"MD5 (weird (1).img) = " + helloMD5 + "\n"
+	tests := []struct {
+		name     string
+		content  string
+		filename string
+		want     string
+		ok       bool
+	}{
+		{"gnu", gnu, "image.img", "sha256:" + helloSHA256, true},
+		{"gnu binary", gnu, "binary.img", "sha256:" + helloSHA256, true},
+		{"gnu md5", gnu, "other.img", "md5:" + helloMD5, true},
+		{"gnu path", gnu, "nested.img", "sha256:" + helloSHA256, true},
+		{"bsd", bsd, "image.qcow2", "sha256:" + helloSHA256, true},
+		{"bsd parentheses", bsd, "weird (1).img", "md5:" + helloMD5, true},
+		{"gnu missing", gnu, "missing.img", "", false},
+		{"bsd missing", bsd, "image.img", "", false},
+		{"empty", "", "image.img", "", false},
+	}
+	for _, tt := range tests {
+		d, ok := lookupDigest([]byte(tt.content), tt.filename)
+		if ok != tt.ok || (ok && d.String() != tt.want) {
+			t.Errorf("%s: got %s, %t, want %s, %t", tt.name, d, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExpectedDigestAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "image.img")
+	if err := os.WriteFile(imagePath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sums := filepath.Join(dir, "SHA256SUMS")
+	if err := os.WriteFile(sums, []byte(helloSHA256+"  image.img\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		checksum string
+		want     string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"md5:" + helloMD5, "md5:" + helloMD5, false},
+		{sums, "sha256:" + helloSHA256, false},
+		{filepath.Join(dir, "missing"), "", true},
+	}
+	for _, tt := range tests {
+		img := &Image{ImageLocation: "https://example.com/images/image.img", Checksum: tt.checksum}
+		d, err := img.expectedDigest()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %s, want an error", tt.checksum, d)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tt.checksum, err)
+		}
+		if d == nil {
+			if tt.want != "" {
+				t.Errorf("%q: got no digest, want %s", tt.checksum, tt.want)
+			}
+			continue
+		}
+		if d.String() != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.checksum, d, tt.want)
+		}
+		if err := verify(imagePath, *d); err != nil {
+			t.Errorf("%q: %s", tt.checksum, err)
+		}
+	}
+
+	img := &Image{ImageLocation: "https://example.com/images/other.img", Checksum: sums}
+	if _, err := img.expectedDigest(); err == nil {
+		t.Error("got a digest for an image missing in the checksum file")
+	}
+	wrong, _ := parseDigest("sha256:" + strings.Repeat("0", 64))
+	if err := verify(imagePath, wrong); err == nil {
+		t.Error("verifying against a wrong digest succeeded")
+	}
+}
@@ -0,0 +1,254 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Disk formats of image volumes, named as qemu-img does.
+const (
+	FormatQCOW2 = "qcow2"
+	FormatRaw   = "raw"
+	FormatVMDK  = "vmdk"
+	FormatVHDX  = "vhdx"
+	FormatVDI   = "vdi"
+	FormatVPC   = "vpc"
+)
+
+// headerSize is how much of an image is read to detect its format.
+const headerSize = 512
+
+// vpcFooterSize is the size of the footer VHD images end with. Fixed VHD
+// images have no header, the footer is all that identifies them.
+const vpcFooterSize = 512
+
+// formatMagics identify disk formats by the bytes at offset, images
+// matching none are raw.
+var formatMagics = []struct {
+	format string
+	offset int
+	magic  string
+}{
+	{FormatQCOW2, 0, "QFI\xfb"},
+	{FormatVMDK, 0, "KDMV"},
+	{FormatVMDK, 0, "# Disk DescriptorFile"},
+	{FormatVHDX, 0, "vhdxfile"},
+	{FormatVDI, 0x40, "\x7f\x10\xda\xbe"},
+	{FormatVPC, 0, vpcMagic},
+}
+
+// vpcMagic starts the footer of VHD images, dynamic ones copy the footer
+// to the start of the file.
+const vpcMagic = "conectix"
+
+// compressions identify compressed downloads by their magic, tool is the
+// command decompressing to stdout, gzip needs none.
+var compressions = []struct {
+	name  string
+	magic string
+	tool  []string
+}{
+	{"gzip", "\x1f\x8b", nil},
+	{"xz", "\xfd7zXZ\x00", []string{"xz", "-dc"}},
+	{"zstd", "\x28\xb5\x2f\xfd", []string{"zstd", "-dc"}},
+}
+
+// BackingFormat returns the format overlays of the image reference, images
+// without a known format are taken for qcow2.
+func (i *Image) BackingFormat() string {
+	if i.Format == "" {
+		return FormatQCOW2
+	}
+	return i.Format
+}
+
+func readHeader(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+// detectCompression returns the name of the compression of an image,
+// empty if it is not compressed.
+func detectCompression(header []byte) string {
+	for _, c := range compressions {
+		if bytes.HasPrefix(header, []byte(c.magic)) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// readFooter returns the last vpcFooterSize bytes of filename, all of it
+// if it is smaller.
+func readFooter(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := fi.Size() - vpcFooterSize
+	if offset < 0 {
+		offset = 0
+	}
+	footer := make([]byte, fi.Size()-offset)
+	if _, err := f.ReadAt(footer, offset); err != nil {
+		return nil, err
+	}
+	return footer, nil
+}
+
+// fileFormat detects the format of the image at filename from its header
+// and, for fixed VHD images, its footer.
+func fileFormat(filename string) (string, error) {
+	header, err := readHeader(filename)
+	if err != nil {
+		return "", err
+	}
+	if format := detectFormat(header); format != FormatRaw {
+		return format, nil
+	}
+	footer, err := readFooter(filename)
+	if err != nil {
+		return "", err
+	}
+	return detectFooter(footer), nil
+}
+
+// detectFooter returns FormatVPC for the footer of a VHD image, FormatRaw
+// otherwise. Images written before Virtual PC 2004 have a 511 byte footer.
+func detectFooter(footer []byte) string {
+	for _, offset := range []int{0, 1} {
+		if len(footer) >= offset+len(vpcMagic) && string(footer[offset:offset+len(vpcMagic)]) == vpcMagic {
+			return FormatVPC
+		}
+	}
+	return FormatRaw
+}
+
+func detectFormat(header []byte) string {
+	for _, m := range formatMagics {
+		if len(header) >= m.offset+len(m.magic) && string(header[m.offset:m.offset+len(m.magic)]) == m.magic {
+			return m.format
+		}
+	}
+	return FormatRaw
+}
+
+// importImage decompresses the image at filename and converts it to qcow2
+// in dir if needed, it returns the file to upload and its format.
+func (i *Image) importImage(filename, dir string) (string, string, error) {
+	header, err := readHeader(filename)
+	if err != nil {
+		return "", "", err
+	}
+	if c := detectCompression(header); c != "" {
+		log.Infof("Decompressing %s image %s\n", c, i.Name)
+		decompressed := filepath.Join(dir, i.Name+".decompressed")
+		if err := decompress(filename, decompressed, c); err != nil {
+			return "", "", fmt.Errorf("decompressing %s image %s: %s", c, i.Name, err)
+		}
+		filename = decompressed
+	}
+	format, err := fileFormat(filename)
+	if err != nil {
+		return "", "", err
+	}
+	if format == FormatQCOW2 {
+		return filename, format, nil
+	}
+	log.Infof("Converting %s image %s to qcow2\n", format, i.Name)
+	converted := filepath.Join(dir, i.Name+".qcow2")
+	cmd := exec.Command("qemu-img", "convert", "-f", format, "-O", FormatQCOW2, filename, converted)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			err = fmt.Errorf("%s: %s", err, out)
+		}
+		return "", "", fmt.Errorf("converting %s image %s: %s", format, i.Name, err)
+	}
+	return converted, FormatQCOW2, nil
+}
+
+func decompress(filename, decompressed, compression string) error {
+	var tool []string
+	for _, c := range compressions {
+		if c.name == compression {
+			tool = c.tool
+		}
+	}
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(decompressed)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if tool == nil {
+		r, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			return err
+		}
+		if err := r.Close(); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool[0], tool[1:]...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+	return out.Close()
+}
+
+// virtualSize returns the disk size of the image, for qcow2 it is in the
+// header, other formats are uploaded raw and have their file size.
+func virtualSize(filename, format string) (uint64, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	if format != FormatQCOW2 {
+		return uint64(fi.Size()), nil
+	}
+	header, err := readHeader(filename)
+	if err != nil {
+		return 0, err
+	}
+	if len(header) < 32 {
+		return 0, fmt.Errorf("%s: truncated qcow2 header", filename)
+	}
+	return binary.BigEndian.Uint64(header[24:32]), nil
+}
@@ -0,0 +1,193 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// qcow2Header is the start of a qcow2 image of 1G.
+var qcow2Header = append(append([]byte("QFI\xfb\x00\x00\x00\x03"), make([]byte, 16)...), 0, 0, 0, 0, 0x40, 0, 0, 0)
+
+func TestDetectFormat(t *testing.T) {
+	vdi := make([]byte, 0x44)
+	copy(vdi, "<<< Oracle VM VirtualBox Disk Image >>>\n")
+	copy(vdi[0x40:], "\x7f\x10\xda\xbe")
+	mbr := make([]byte, 512)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"qcow2", qcow2Header, FormatQCOW2},
+		{"vmdk", []byte("KDMV\x01\x00\x00\x00"), FormatVMDK},
+		{"vmdk descriptor", []byte("# Disk DescriptorFile\nversion=1\n"), FormatVMDK},
+		{"vhdx", []byte("vhdxfile"), FormatVHDX},
+		{"vdi", vdi, FormatVDI},
+		{"vpc", []byte("conectix\x00\x00\x00\x02"), FormatVPC},
+		{"raw", mbr, FormatRaw},
+		{"short", []byte("QF"), FormatRaw},
+		{"empty", nil, FormatRaw},
+	}
+	for _, tt := range tests {
+		if got := detectFormat(tt.header); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// vhdFooter returns the footer of a fixed VHD image of size bytes.
+func vhdFooter(size uint64) []byte {
+	footer := make([]byte, vpcFooterSize)
+	copy(footer, "conectix\x00\x00\x00\x02\x00\x01\x00\x00")
+	// no dynamic header
+	copy(footer[16:], "\xff\xff\xff\xff\xff\xff\xff\xff")
+	binary.BigEndian.PutUint64(footer[40:], size)
+	binary.BigEndian.PutUint64(footer[48:], size)
+	// disk type fixed
+	binary.BigEndian.PutUint32(footer[60:], 2)
+	return footer
+}
+
+func TestFileFormat(t *testing.T) {
+	data := bytes.Repeat([]byte{0}, 2048)
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"qcow2", qcow2Header, FormatQCOW2},
+		{"fixed vhd", append(append([]byte(nil), data...), vhdFooter(uint64(len(data)))...), FormatVPC},
+		{"fixed vhd 511 byte footer", append(append([]byte(nil), data...), vhdFooter(uint64(len(data)))[:511]...), FormatVPC},
+		{"dynamic vhd", append(vhdFooter(1<<30), data...), FormatVPC},
+		{"footer only", vhdFooter(0), FormatVPC},
+		{"raw", data, FormatRaw},
+		{"raw with magic inside", append(append(append([]byte(nil), data...), "conectix"...), data...), FormatRaw},
+		{"short", []byte("con"), FormatRaw},
+		{"empty", nil, FormatRaw},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "image")
+		if err := os.WriteFile(filename, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := fileFormat(filename)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"gzip", []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00"), "gzip"},
+		{"xz", []byte("\xfd7zXZ\x00\x00\x04"), "xz"},
+		{"zstd", []byte("\x28\xb5\x2f\xfd\x04\x58"), "zstd"},
+		{"qcow2", qcow2Header, ""},
+		{"xz prefix only", []byte("\xfd7zX"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := detectCompression(tt.header); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestImportImage(t *testing.T) {
+	raw := bytes.Repeat([]byte{0}, 1024)
+	tests := []struct {
+		name string
+		// compress writes the fixture compressed to filename, nil keeps
+		// it as is
+		compress func(t *testing.T, filename string, content []byte)
+		content  []byte
+		tool     string
+	}{
+		{"qcow2", nil, qcow2Header, ""},
+		{"gzip", gzipFile, qcow2Header, ""},
+		{"xz", toolFile("xz"), qcow2Header, "xz"},
+		{"zstd", toolFile("zstd"), qcow2Header, "zstd"},
+		{"raw", nil, raw, "qemu-img"},
+		{"gzip raw", gzipFile, raw, "qemu-img"},
+		{"fixed vhd", nil, append(append([]byte(nil), raw...), vhdFooter(uint64(len(raw)))...), "qemu-img"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.tool != "" {
+				if _, err := exec.LookPath(tt.tool); err != nil {
+					t.Skipf("%s is not installed", tt.tool)
+				}
+			}
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "download")
+			if tt.compress != nil {
+				tt.compress(t, filename, tt.content)
+			} else if err := os.WriteFile(filename, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			img := &Image{Name: "test"}
+			imported, format, err := img.importImage(filename, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != FormatQCOW2 {
+				t.Errorf("got format %s, want qcow2", format)
+			}
+			header, err := readHeader(imported)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detectFormat(header) != FormatQCOW2 {
+				t.Errorf("imported image %s is no qcow2", filepath.Base(imported))
+			}
+			if !bytes.Equal(tt.content, qcow2Header) {
+				return
+			}
+			if got, err := os.ReadFile(imported); err != nil || !bytes.Equal(got, qcow2Header) {
+				t.Errorf("imported image %s differs from the fixture", filepath.Base(imported))
+			}
+			if tt.compress == nil && imported != filename {
+				t.Errorf("got %s for a qcow2 image, want it used as is", imported)
+			}
+		})
+	}
+}
+
+func gzipFile(t *testing.T, filename string, content []byte) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(content)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func toolFile(tool string) func(t *testing.T, filename string, content []byte) {
+	return func(t *testing.T, filename string, content []byte) {
+		cmd := exec.Command(tool, "-c")
+		cmd.Stdin = bytes.NewReader(content)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %s", tool, err)
+		}
+		if err := os.WriteFile(filename, out, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -1,18 +1,16 @@
 package image
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 
 	"github.com/jedib0t/go-pretty/v6/table"
-	"github.com/michaelhenkel/gokvm/qemu"
+	"github.com/michaelhenkel/gokvm/backend"
 
 	log "github.com/sirupsen/logrus"
-	libvirt "libvirt.org/libvirt-go"
 	libvirtxml "libvirt.org/libvirt-go-xml"
 )
 
@@ -23,14 +21,51 @@ const (
 	File ImageLocationType = "file"
 )
 
+// SeedFormat is the layout of the cloud-init seed of instances created
+// from the image.
+type SeedFormat string
+
+const (
+	// NoCloud is a CIDATA volume with meta-data, user-data and
+	// network-config.
+	NoCloud SeedFormat = "nocloud"
+	// ConfigDrive is an OpenStack config drive labeled config-2, for
+	// images only enabling the ConfigDrive datasource.
+	ConfigDrive SeedFormat = "configdrive"
+)
+
+// ParseSeedFormat returns the seed format named s, empty is NoCloud.
+func ParseSeedFormat(s string) (SeedFormat, error) {
+	switch SeedFormat(s) {
+	case "", NoCloud:
+		return NoCloud, nil
+	case ConfigDrive:
+		return ConfigDrive, nil
+	}
+	return "", fmt.Errorf("unknown seed format %q, known are %s, %s", s, NoCloud, ConfigDrive)
+}
+
 type Image struct {
 	Name              string
 	ImageLocationType ImageLocationType
 	ImageLocation     string
 	File              string
-	MD5Name           string
-	Path              string
-	Pool              string
+	// Checksum is the URL or path of a checksum file (MD5SUMS,
+	// SHA256SUMS, ...) listing the image, or its digest as
+	// [<algorithm>:]<hex>. The image is not verified if empty.
+	Checksum string
+	// Digest is the verified digest of the image as <algorithm>:<hex>.
+	Digest string
+	Path   string
+	Pool   string
+	// Distro is the distro profile of the image, see distro.Lookup.
+	Distro string
+	// SeedFormat is the cloud-init seed layout, empty is NoCloud.
+	SeedFormat SeedFormat
+	// Format is the disk format of the volume. If it is empty on create
+	// the image is decompressed and converted to qcow2 as needed,
+	// otherwise it is uploaded as is.
+	Format string
 }
 
 func DefaultImage() Image {
@@ -38,13 +73,15 @@ func DefaultImage() Image {
 		Name:              "gokvm-default",
 		ImageLocationType: URL,
 		ImageLocation:     "https://cloud-images.ubuntu.com/releases/focal/release-20210315/ubuntu-20.04-server-cloudimg-amd64.img",
+		Checksum:          "https://cloud-images.ubuntu.com/releases/focal/release-20210315/SHA256SUMS",
 		Path:              "/var/lib/libvirt/images",
 		Pool:              "gokvm",
+		Distro:            "ubuntu-20.04",
 	}
 }
 
-func Get(name string, poolName string) (*Image, error) {
-	images, err := List(poolName)
+func Get(l backend.Backend, name string, poolName string) (*Image, error) {
+	images, err := List(l, poolName)
 	if err != nil {
 		return nil, err
 	}
@@ -56,32 +93,28 @@ func Get(name string, poolName string) (*Image, error) {
 	return nil, nil
 }
 
-func List(poolName string) ([]*Image, error) {
-	l, err := qemu.Connnect()
-	if err != nil {
-		return nil, err
-	}
+func List(l backend.Backend, poolName string) ([]*Image, error) {
 	if poolName == "" {
 		poolName = "gokvm"
 	}
-	pool, err := l.LookupStoragePoolByName(poolName)
+	pool, err := l.LookupStoragePool(poolName)
 	if err != nil {
-		lerr, ok := err.(libvirt.Error)
-		if !ok {
-			return nil, err
-		}
-		if lerr.Code == libvirt.ERR_NO_STORAGE_POOL {
+		if errors.Is(err, backend.ErrNotFound) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	vols, err := pool.ListAllStorageVolumes(0)
+	vols, err := pool.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+	uri, err := l.URI()
 	if err != nil {
 		return nil, err
 	}
 	var images []*Image
 	for _, vol := range vols {
-		img, err := volumeToImage(vol, poolName)
+		img, err := volumeToImage(vol, uri, poolName)
 		if err != nil {
 			return nil, err
 		}
@@ -91,8 +124,8 @@ func List(poolName string) ([]*Image, error) {
 	return images, nil
 }
 
-func volumeToImage(vol libvirt.StorageVol, poolName string) (*Image, error) {
-	volXML, err := vol.GetXMLDesc(0)
+func volumeToImage(vol backend.StorageVolume, uri, poolName string) (*Image, error) {
+	volXML, err := vol.XML()
 	if err != nil {
 		return nil, err
 	}
@@ -100,51 +133,58 @@ func volumeToImage(vol libvirt.StorageVol, poolName string) (*Image, error) {
 	if err := xmlVol.Unmarshal(volXML); err != nil {
 		return nil, err
 	}
+	imgInfo, err := loadInfo(uri, poolName, xmlVol.Name)
+	if err != nil {
+		return nil, err
+	}
+	var format string
+	if xmlVol.Target != nil && xmlVol.Target.Format != nil {
+		format = xmlVol.Target.Format.Type
+	}
 	return &Image{
-		Name: xmlVol.Name,
-		Path: xmlVol.Key,
-		Pool: poolName,
+		Name:       xmlVol.Name,
+		Path:       xmlVol.Key,
+		Pool:       poolName,
+		Distro:     imgInfo.Distro,
+		SeedFormat: imgInfo.SeedFormat,
+		Digest:     imgInfo.Digest,
+		Format:     format,
 	}, nil
 }
 
 func Render(images []*Image) {
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
-	t.AppendHeader(table.Row{"Pool", "Volume"})
+	t.AppendHeader(table.Row{"Pool", "Volume", "Format", "Distro", "Seed"})
 	var tableRows []table.Row
 	for _, img := range images {
-		tableRows = append(tableRows, table.Row{img.Pool, img.Name})
+		tableRows = append(tableRows, table.Row{img.Pool, img.Name, img.Format, img.Distro, img.SeedFormat})
 	}
 	t.AppendRows(tableRows)
 	t.SetStyle(table.StyleLight)
 	t.Render()
 }
 
-func (i *Image) Delete() error {
-	l, err := qemu.Connnect()
-	if err != nil {
-		return nil
-	}
-	pool, err := l.LookupStoragePoolByName(i.Pool)
+func (i *Image) Delete(l backend.Backend) error {
+	pool, err := l.LookupStoragePool(i.Pool)
 	if err != nil {
 		return nil
 	}
-	vol, err := pool.LookupStorageVolByName(i.Name)
+	vol, err := pool.LookupVolume(i.Name)
 	if err != nil {
-		lerr, ok := err.(libvirt.Error)
-		if !ok {
-			return err
-		}
-		if lerr.Code != libvirt.ERR_NO_STORAGE_VOL {
+		if !errors.Is(err, backend.ErrNotFound) {
 			return err
 		}
 	}
 	if vol != nil {
-		if err := vol.Delete(0); err != nil {
+		if err := vol.Delete(); err != nil {
 			return err
 		}
 	}
-	vols, err := pool.ListStorageVolumes()
+	if err := i.saveInfo(l, info{}); err != nil {
+		return err
+	}
+	vols, err := pool.ListVolumes()
 	if err != nil {
 		return nil
 	}
@@ -159,141 +199,155 @@ func (i *Image) Delete() error {
 	return nil
 }
 
-func (i *Image) Create() error {
-	if err := i.createPool(); err != nil {
+func (i *Image) Create(l backend.Backend) error {
+	if err := i.createPool(l); err != nil {
 		return err
 	}
-	l, err := qemu.Connnect()
+	pool, err := l.LookupStoragePool(i.Pool)
 	if err != nil {
 		return nil
 	}
-	pool, err := l.LookupStoragePoolByName(i.Pool)
+	_, err = pool.LookupVolume(i.Name)
 	if err != nil {
-		return nil
-	}
-	_, err = pool.LookupStorageVolByName(i.Name)
-	if err != nil {
-		lerr, ok := err.(libvirt.Error)
-		if !ok {
-			return err
-		}
-		if lerr.Code == libvirt.ERR_NO_STORAGE_VOL {
-			return i.createVolume(pool, l)
+		if errors.Is(err, backend.ErrNotFound) {
+			if err := i.createVolume(l, pool); err != nil {
+				return err
+			}
+			if _, ok := l.(backend.Recorder); ok {
+				return nil
+			}
+			// the location is gone once the volume exists, keep what it
+			// tells about the distro
+			profile, err := i.Profile()
+			if err != nil {
+				return err
+			}
+			return i.saveInfo(l, info{Distro: profile.Name(), SeedFormat: i.SeedFormat, Digest: i.Digest})
 		}
+		return err
 	}
 	return nil
 
 }
 
-func (i *Image) createVolume(pool *libvirt.StoragePool, l *libvirt.Connect) error {
-	dir, err := ioutil.TempDir("/tmp", "prefix")
-	if err != nil {
-		return err
+func (i *Image) createVolume(l backend.Backend, pool backend.StoragePool) error {
+	if r, ok := l.(backend.Recorder); ok {
+		switch i.ImageLocationType {
+		case URL:
+			r.Record("download", i.Name, i.ImageLocation)
+		case File:
+			r.Record("copy", i.Name, i.ImageLocation)
+		}
+		if i.Checksum != "" {
+			r.Record("verify", i.Name, i.Checksum)
+		}
+		return i.defineVolume(pool, i.Format, 0, 0, nil)
 	}
-	defer os.RemoveAll(dir)
-
-	filename := fmt.Sprintf("%s/%s", dir, i.Name)
-	out, err := os.Create(filename)
+	expected, err := i.expectedDigest()
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	log.Infof("Downloading image from %s\n", i.ImageLocation)
+	filename := i.ImageLocation
 	switch i.ImageLocationType {
 	case URL:
-
-		resp, err := http.Get(i.ImageLocation)
-		if err != nil {
+		if filename, err = i.download(); err != nil {
 			return err
 		}
-		defer resp.Body.Close()
+	case File:
+		log.Infof("Copying image from %s\n", i.ImageLocation)
+	}
 
-		_, err = io.Copy(out, resp.Body)
-		if err != nil {
-			return err
+	if expected != nil {
+		if err := verify(filename, *expected); err != nil {
+			if i.ImageLocationType == URL {
+				if err := i.evict(); err != nil {
+					log.Errorf("error evicting %s from the cache: %s", i.ImageLocation, err)
+				}
+			}
+			return fmt.Errorf("image %s: %s", i.Name, err)
 		}
-	case File:
-		f, err := os.Open(i.ImageLocation)
+		log.Infof("Verified image %s as %s\n", i.Name, expected)
+		i.Digest = expected.String()
+	}
+
+	format := i.Format
+	if format == "" {
+		dir, err := ioutil.TempDir("/tmp", "prefix")
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(out, f)
-		if err != nil {
+		defer os.RemoveAll(dir)
+		if filename, format, err = i.importImage(filename, dir); err != nil {
 			return err
 		}
+		i.Format = format
 	}
 
+	capacity, err := virtualSize(filename, format)
+	if err != nil {
+		return err
+	}
 	fi, err := os.Stat(filename)
 	if err != nil {
 		return err
 	}
-	size := fi.Size()
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return i.defineVolume(pool, format, capacity, uint64(fi.Size()), f)
+}
+
+// defineVolume creates the volume in format with capacity and uploads
+// size bytes from r into it, r is nil for an empty volume.
+func (i *Image) defineVolume(pool backend.StoragePool, format string, capacity, size uint64, r io.Reader) error {
 	vol := libvirtxml.StorageVolume{
 		Name: i.Name,
 		Type: "file",
 		Capacity: &libvirtxml.StorageVolumeSize{
 			Unit:  "bytes",
-			Value: uint64(size),
+			Value: capacity,
 		},
 	}
+	if format != "" {
+		vol.Target = &libvirtxml.StorageVolumeTarget{
+			Format: &libvirtxml.StorageVolumeTargetFormat{
+				Type: format,
+			},
+		}
+	}
 	volXML, err := vol.Marshal()
 	if err != nil {
 		return err
 	}
 
-	lvol, err := pool.StorageVolCreateXML(volXML, 0)
+	lvol, err := pool.CreateVolume(volXML)
 	if err != nil {
 		log.Error("error creating volume")
 		return err
 	}
 
-	stream, err := l.NewStream(0)
-	if err != nil {
+	if r == nil {
 		return nil
 	}
-
-	if err := lvol.Upload(stream, 0, uint64(size), 0); err != nil {
+	if err := lvol.Upload(r, size); err != nil {
 		log.Error("error uploading")
-		return err
-	}
-
-	f, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	r := bufio.NewReader(f)
-
-	if err := stream.SendAll(func(stream *libvirt.Stream, i int) ([]byte, error) {
-		return readNBytes(r, int64(i))
-	}); err != nil {
+		// a partial volume would be taken for the image
+		if err := lvol.Delete(); err != nil {
+			log.Errorf("error deleting volume %s: %s", i.Name, err)
+		}
 		return err
 	}
 	return nil
 }
 
-func uploadVolume() {
-
-}
-
-func readNBytes(r *bufio.Reader, peek int64) ([]byte, error) {
-	return ioutil.ReadAll(io.LimitReader(r, peek))
-}
-
-func (i *Image) createPool() error {
-	l, err := qemu.Connnect()
-	if err != nil {
-		return err
-	}
-	_, err = l.LookupStoragePoolByName(i.Pool)
+func (i *Image) createPool(l backend.Backend) error {
+	_, err := l.LookupStoragePool(i.Pool)
 	if err == nil {
 		return nil
 	}
-	if _, err := os.Stat(fmt.Sprintf("%s/%s", i.Path, i.Pool)); os.IsNotExist(err) {
-		if err := os.Mkdir(fmt.Sprintf("%s/%s", i.Path, i.Pool), 0755); err != nil {
-			return err
-		}
-	}
 	storagePool := &libvirtxml.StoragePool{
 		Name: i.Pool,
 		Type: "dir",
@@ -305,14 +359,14 @@ func (i *Image) createPool() error {
 	if err != nil {
 		return err
 	}
-	p, err := l.StoragePoolDefineXML(poolXML, 0)
+	p, err := l.DefineStoragePool(poolXML)
 	if err != nil {
 		return err
 	}
 	if err := p.SetAutostart(true); err != nil {
 		return err
 	}
-	if err := p.Create(1); err != nil {
+	if err := p.Create(); err != nil {
 		return err
 	}
 
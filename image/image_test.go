@@ -0,0 +1,111 @@
+package image
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/backend/dryrun"
+	"github.com/michaelhenkel/gokvm/backend/fake"
+)
+
+// otherHost is a fake backend connected to another host.
+type otherHost struct {
+	*fake.Backend
+}
+
+func (h otherHost) URI() (string, error) {
+	return "qemu+ssh://other/system", nil
+}
+
+func TestInfoPerHost(t *testing.T) {
+	dir := t.TempDir()
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	t.Cleanup(func() { os.Setenv("HOME", home) })
+	imagePath := filepath.Join(dir, "image.qcow2")
+	if err := os.WriteFile(imagePath, qcow2Header, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hosts := []struct {
+		l      backend.Backend
+		distro string
+	}{
+		{fake.New(), "ubuntu-22.04"},
+		{otherHost{fake.New()}, "debian-12"},
+	}
+	for _, host := range hosts {
+		img := &Image{
+			Name:              "test",
+			Pool:              "gokvm",
+			Path:              dir,
+			ImageLocationType: File,
+			ImageLocation:     imagePath,
+			Distro:            host.distro,
+		}
+		if err := img.Create(host.l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, host := range hosts {
+		img, err := Get(host.l, "test", "gokvm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img == nil || img.Distro != host.distro {
+			t.Errorf("got image %+v, want distro %s", img, host.distro)
+		}
+	}
+	if err := (&Image{Name: "test", Pool: "gokvm"}).Delete(hosts[1].l); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := Get(hosts[0].l, "test", "gokvm"); err != nil || img == nil || img.Distro != hosts[0].distro {
+		t.Errorf("got image %+v after deleting it on the other host, want distro %s", img, hosts[0].distro)
+	}
+}
+
+func TestCreateDryRun(t *testing.T) {
+	tests := []struct {
+		name         string
+		locationType ImageLocationType
+		location     string
+		want         string
+	}{
+		{"url", URL, "https://example.com/image.img", "# download test\nhttps://example.com/image.img\n"},
+		{"file", File, "/missing/image.img", "# copy test\n/missing/image.img\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			real := fake.New()
+			var out bytes.Buffer
+			l := dryrun.New(real, &out)
+			img := &Image{
+				Name:              "test",
+				Pool:              "gokvm",
+				Path:              "/var/lib/libvirt/images",
+				ImageLocationType: tt.locationType,
+				ImageLocation:     tt.location,
+				Checksum:          "md5:" + helloMD5,
+			}
+			if err := img.Create(l); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), tt.want) || !strings.Contains(out.String(), "# verify test\nmd5:"+helloMD5) {
+				t.Errorf("got output %q, want %q and the checksum", out.String(), tt.want)
+			}
+			created, err := Get(l, "test", "gokvm")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created == nil {
+				t.Fatal("image test is missing in the dry run")
+			}
+			if _, err := real.LookupStoragePool("gokvm"); err == nil {
+				t.Error("pool gokvm was defined in the real backend")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/config"
+	"github.com/michaelhenkel/gokvm/distro"
+	"gopkg.in/yaml.v3"
+)
+
+// info is what gokvm knows about an image beyond its volume. Volumes have
+// no metadata, it is kept in images/<pool>/<name>.yaml in the
+// config.HostDir of the connection.
+type info struct {
+	Distro     string     `yaml:"distro,omitempty"`
+	SeedFormat SeedFormat `yaml:"seedFormat,omitempty"`
+	Digest     string     `yaml:"digest,omitempty"`
+}
+
+// Profile returns the distro profile of the image, it is guessed from the
+// name and location if the image has no distro.
+func (i *Image) Profile() (distro.Profile, error) {
+	if i.Distro != "" {
+		return distro.Lookup(i.Distro)
+	}
+	return distro.Detect(i.Name, i.ImageLocation), nil
+}
+
+func infoFile(uri, pool, name string) (string, error) {
+	dir, err := config.HostDir(uri)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "images", pool, name+".yaml"), nil
+}
+
+func loadInfo(uri, pool, name string) (*info, error) {
+	path, err := infoFile(uri, pool, name)
+	if err != nil {
+		return nil, err
+	}
+	imgInfo := &info{}
+	f, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return imgInfo, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(f, imgInfo); err != nil {
+		return nil, err
+	}
+	return imgInfo, nil
+}
+
+// saveInfo writes the info of the image, an empty info removes the file.
+func (i *Image) saveInfo(l backend.Backend, imgInfo info) error {
+	uri, err := l.URI()
+	if err != nil {
+		return err
+	}
+	path, err := infoFile(uri, i.Pool, i.Name)
+	if err != nil {
+		return err
+	}
+	if imgInfo == (info{}) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(&imgInfo)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0644)
+}
@@ -0,0 +1,65 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const progressWidth = 30
+
+// progress draws a progress bar of a download on stderr, it stays silent
+// if stderr is no terminal.
+type progress struct {
+	name     string
+	current  int64
+	total    int64
+	rendered time.Time
+	enabled  bool
+}
+
+// newProgress starts a bar at current of total bytes, total is -1 if
+// unknown.
+func newProgress(name string, current, total int64) *progress {
+	return &progress{
+		name:    name,
+		current: current,
+		total:   total,
+		enabled: terminal.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.current += int64(len(b))
+	if time.Since(p.rendered) > 200*time.Millisecond {
+		p.render()
+	}
+	return len(b), nil
+}
+
+func (p *progress) render() {
+	if !p.enabled {
+		return
+	}
+	p.rendered = time.Now()
+	if p.total <= 0 {
+		fmt.Fprintf(os.Stderr, "\r%s %s", p.name, bytefmt.ByteSize(uint64(p.current)))
+		return
+	}
+	filled := int(p.current * progressWidth / p.total)
+	fmt.Fprintf(os.Stderr, "\r%s [%-*s] %3d%% %s/%s", p.name, progressWidth, strings.Repeat("=", filled),
+		p.current*100/p.total, bytefmt.ByteSize(uint64(p.current)), bytefmt.ByteSize(uint64(p.total)))
+}
+
+// done draws the final state and ends the line.
+func (p *progress) done() {
+	if !p.enabled {
+		return
+	}
+	p.render()
+	fmt.Fprintln(os.Stderr)
+}
@@ -0,0 +1,168 @@
+package instance
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+)
+
+const (
+	agentTimeout = 10 * time.Second
+	// ExecTimeout is how long commands run through the guest agent are
+	// waited for by default.
+	ExecTimeout = 5 * time.Minute
+	// agentChunkSize is the amount of file data per guest agent call,
+	// requests and replies carry it base64 encoded.
+	agentChunkSize = 48 * 1024
+)
+
+// ExecResult is the outcome of a command run through the guest agent.
+type ExecResult struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+type agentRequest struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// agentCommand runs command with arguments in the guest agent and decodes
+// the "return" member of the reply into result.
+func (i *Instance) agentCommand(l backend.Backend, command string, arguments, result interface{}) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	request, err := json.Marshal(agentRequest{Execute: command, Arguments: arguments})
+	if err != nil {
+		return err
+	}
+	reply, err := domain.AgentCommand(string(request), agentTimeout)
+	if err != nil {
+		return fmt.Errorf("guest agent %s: %s", command, err)
+	}
+	var response struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(reply), &response); err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Return, result)
+}
+
+// Exec runs args in the guest and waits for it to exit or ctx to be done.
+// stdin is passed to the command if not nil. The guest agent cannot kill
+// the command, it keeps running when ctx is done first.
+func (i *Instance) Exec(ctx context.Context, l backend.Backend, args []string, stdin []byte) (*ExecResult, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command given")
+	}
+	arguments := map[string]interface{}{
+		"path":           args[0],
+		"arg":            args[1:],
+		"capture-output": true,
+	}
+	if stdin != nil {
+		arguments["input-data"] = base64.StdEncoding.EncodeToString(stdin)
+	}
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := i.agentCommand(l, "guest-exec", arguments, &started); err != nil {
+		return nil, err
+	}
+	for {
+		var status struct {
+			Exited   bool   `json:"exited"`
+			ExitCode int    `json:"exitcode"`
+			Signal   int    `json:"signal"`
+			OutData  []byte `json:"out-data"`
+			ErrData  []byte `json:"err-data"`
+		}
+		if err := i.agentCommand(l, "guest-exec-status", map[string]int{"pid": started.PID}, &status); err != nil {
+			return nil, err
+		}
+		if status.Exited {
+			result := &ExecResult{
+				ExitCode: status.ExitCode,
+				Stdout:   status.OutData,
+				Stderr:   status.ErrData,
+			}
+			if status.Signal != 0 {
+				result.ExitCode = 128 + status.Signal
+			}
+			return result, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s in %s: %s", args[0], i.Name, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// CopyTo writes everything read from r to path in the guest.
+func (i *Instance) CopyTo(l backend.Backend, r io.Reader, path string) error {
+	var handle int
+	if err := i.agentCommand(l, "guest-file-open", map[string]string{"path": path, "mode": "w"}, &handle); err != nil {
+		return err
+	}
+	buf := make([]byte, agentChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			arguments := map[string]interface{}{
+				"handle":  handle,
+				"buf-b64": base64.StdEncoding.EncodeToString(buf[:n]),
+			}
+			if werr := i.agentCommand(l, "guest-file-write", arguments, nil); werr != nil {
+				i.agentCommand(l, "guest-file-close", map[string]int{"handle": handle}, nil)
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			i.agentCommand(l, "guest-file-close", map[string]int{"handle": handle}, nil)
+			return err
+		}
+	}
+	return i.agentCommand(l, "guest-file-close", map[string]int{"handle": handle}, nil)
+}
+
+// CopyFrom writes the content of path in the guest to w.
+func (i *Instance) CopyFrom(l backend.Backend, path string, w io.Writer) error {
+	var handle int
+	if err := i.agentCommand(l, "guest-file-open", map[string]string{"path": path, "mode": "r"}, &handle); err != nil {
+		return err
+	}
+	defer i.agentCommand(l, "guest-file-close", map[string]int{"handle": handle}, nil)
+	for {
+		var chunk struct {
+			Count int    `json:"count"`
+			Buf   []byte `json:"buf-b64"`
+			EOF   bool   `json:"eof"`
+		}
+		arguments := map[string]int{"handle": handle, "count": agentChunkSize}
+		if err := i.agentCommand(l, "guest-file-read", arguments, &chunk); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk.Buf); err != nil {
+			return err
+		}
+		if chunk.EOF || chunk.Count == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package instance
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend/fake"
+)
+
+// newAgentBackend returns a fake backend with the running domain vm whose
+// guest agent reports started commands as exited once exited is true.
+func newAgentBackend(t *testing.T, exited bool) *fake.Backend {
+	t.Helper()
+	l := fake.New()
+	domain, err := l.DefineDomain("<domain><name>vm</name></domain>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := domain.Create(); err != nil {
+		t.Fatal(err)
+	}
+	l.SetAgent("vm", func(command string) (string, error) {
+		var request agentRequest
+		if err := json.Unmarshal([]byte(command), &request); err != nil {
+			return "", err
+		}
+		switch request.Execute {
+		case "guest-exec":
+			return `{"return": {"pid": 42}}`, nil
+		case "guest-exec-status":
+			if !exited {
+				return `{"return": {"exited": false}}`, nil
+			}
+			return `{"return": {"exited": true, "exitcode": 3, "out-data": "aGVsbG8="}}`, nil
+		}
+		t.Errorf("unexpected agent command %s", request.Execute)
+		return `{"return": {}}`, nil
+	}, nil)
+	return l
+}
+
+func TestExec(t *testing.T) {
+	inst := &Instance{Name: "vm"}
+	result, err := inst.Exec(context.Background(), newAgentBackend(t, true), []string{"echo", "hello"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 3 || string(result.Stdout) != "hello" {
+		t.Errorf("got exit code %d and stdout %q, want 3 and hello", result.ExitCode, result.Stdout)
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	inst := &Instance{Name: "vm"}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := inst.Exec(ctx, newAgentBackend(t, false), []string{"sleep", "infinity"}, nil)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("got error %v, want the deadline to be exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Exec returned after %s", elapsed)
+	}
+}
@@ -1,120 +1,162 @@
 package instance
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 
 	"github.com/kdomanski/iso9660"
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/distro"
 	"github.com/michaelhenkel/gokvm/image"
 	"gopkg.in/yaml.v3"
 )
 
-func (i *Instance) createCloudInit() (*image.Image, error) {
+// createCloudInit renders the cloud-init seed of the instance into a
+// volume, laid out as NoCloud or config drive as the image asks for.
+func (i *Instance) createCloudInit(l backend.Backend, profile distro.Profile) (*image.Image, error) {
+	passwordHash, err := i.passwordHash(l)
+	if err != nil {
+		return nil, err
+	}
 	ci := cloudInit{
 		Hostname:       i.Name,
 		ManageEtcHosts: true,
 		Users: []user{{
-			Name:              "gokvm",
+			Name:              i.user(),
 			Sudo:              "ALL=(ALL) NOPASSWD:ALL",
-			Home:              "/home/gokvm",
-			Shell:             "/bin/bash",
-			LockPasswd:        false,
-			SSHAuthorizedKeys: []string{i.PubKey},
-		}, {
-			Name:              "root",
+			Home:              "/home/" + i.user(),
+			Shell:             profile.Shell,
+			LockPasswd:        passwordHash == "",
+			Passwd:            passwordHash,
 			SSHAuthorizedKeys: []string{i.PubKey},
 		}},
-		SSHPwauth:   true,
-		DisableRoot: false,
-		Chpasswd: chpasswd{
-			List: `gokvm:gokvm
-root:gokvm`,
-			Expire: false,
-		},
-		WriteFiles: []writeFiles{{
+		SSHPwauth:   i.Credentials.SSHPasswordAuth,
+		DisableRoot: !i.Credentials.RootLogin,
+	}
+	if profile.AgentPackage != "" {
+		ci.Packages = []string{profile.AgentPackage}
+	}
+	nameserver := i.Networks[0].Network.Nameserver().String()
+	switch profile.DNS {
+	case distro.DNSResolved:
+		ci.WriteFiles = append(ci.WriteFiles, writeFiles{
 			Content: `[Resolve]
-DNS=` + i.Network.DNSServer.String(),
+DNS=` + nameserver,
 			Path: "/etc/systemd/resolved.conf",
-		}},
-		RunCMD: []string{
+		})
+		ci.RunCMD = append(ci.RunCMD,
 			"systemctl restart systemd-resolved.service",
 			"cat /etc/systemd/resolved.conf > /run/test",
-		},
+		)
+	case distro.DNSResolvConf:
+		ci.ManageResolvConf = true
+		ci.ResolvConf = &resolvConf{Nameservers: []string{nameserver}}
+	case distro.DNSFile:
+		ci.WriteFiles = append(ci.WriteFiles, writeFiles{
+			Content: "nameserver " + nameserver + "\n",
+			Path:    "/etc/resolv.conf",
+		})
 	}
-	out, err := ioutil.TempDir("/tmp", "prefix")
-	if err != nil {
-		return nil, err
+	// cloud-init rewrites /etc/hosts on every boot if it manages it
+	if hosts := i.etcHosts(); hosts != "" {
+		ci.ManageEtcHosts = false
+		ci.WriteFiles = append(ci.WriteFiles, writeFiles{
+			Content: hosts,
+			Path:    "/etc/hosts",
+		})
 	}
-	defer os.RemoveAll(out)
-
-	cloudInitPath := out + "/config"
-	metaDataPath := cloudInitPath + "/meta-data"
-	userDataPath := cloudInitPath + "/user-data"
-	if err := os.Mkdir(cloudInitPath, 0755); err != nil {
-		return nil, err
+	if profile.AgentPackage != "" {
+		ci.RunCMD = append(ci.RunCMD, profile.StartService(profile.AgentPackage)...)
+	}
+	if i.Credentials.RootLogin {
+		ci.Users = append(ci.Users, user{
+			Name:              "root",
+			LockPasswd:        true,
+			SSHAuthorizedKeys: []string{i.PubKey},
+		})
 	}
-
 	ciByte, err := yaml.Marshal(&ci)
 	if err != nil {
 		return nil, err
 	}
-
-	userDataHeader := fmt.Sprintf("#cloud-config\n%s", string(ciByte))
-	userDataOut := []byte(userDataHeader)
-
-	if err := os.WriteFile(userDataPath, userDataOut, 0600); err != nil {
-		return nil, err
-	}
-
-	defaultMetaData := &metaData{
-		InstanceId:    ci.Hostname,
-		LocalHostname: ci.Hostname,
-	}
-
-	metaDataYAML, err := yaml.Marshal(defaultMetaData)
+	userData, err := i.mergeUserData(ciByte)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := os.WriteFile(metaDataPath, metaDataYAML, 0600); err != nil {
-		return nil, err
+	var files []seedFile
+	var label string
+	switch i.Image.SeedFormat {
+	case image.ConfigDrive:
+		label = "config-2"
+		metaDataJSON, err := i.configDriveMetaData()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files,
+			seedFile{name: "openstack/latest/meta_data.json", content: metaDataJSON},
+			seedFile{name: "openstack/latest/user_data", content: userData},
+		)
+		if i.hasStaticAddress() {
+			networkData, err := i.networkData()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, seedFile{name: "openstack/latest/network_data.json", content: networkData})
+		}
+	default:
+		label = "CIDATA"
+		metaDataYAML, err := yaml.Marshal(&metaData{
+			InstanceId:    ci.Hostname,
+			LocalHostname: ci.Hostname,
+		})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files,
+			seedFile{name: "user-data", content: userData},
+			seedFile{name: "meta-data", content: metaDataYAML},
+		)
+		if i.hasStaticAddress() {
+			networkConfig, err := i.networkConfig()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, seedFile{name: "network-config", content: networkConfig})
+		}
 	}
-
-	writer, err := iso9660.NewWriter()
-	if err != nil {
-		return nil, err
+	if r, ok := l.(backend.Recorder); ok {
+		for _, file := range files {
+			r.Record(file.name, i.Name, string(file.content))
+		}
 	}
-	defer writer.Cleanup()
 
-	userData, err := os.Open(out + "/config/user-data")
-	if err != nil {
-		return nil, err
-	}
-	defer userData.Close()
-
-	err = writer.AddFile(userData, "user-data")
+	out, err := ioutil.TempDir("/tmp", "prefix")
 	if err != nil {
 		return nil, err
 	}
+	defer os.RemoveAll(out)
 
-	metaData, err := os.Open(out + "/config/meta-data")
+	writer, err := iso9660.NewWriter()
 	if err != nil {
 		return nil, err
 	}
-	defer metaData.Close()
+	defer writer.Cleanup()
 
-	err = writer.AddFile(metaData, "meta-data")
-	if err != nil {
-		return nil, err
+	for _, file := range files {
+		if err := writer.AddFile(bytes.NewReader(file.content), file.name); err != nil {
+			return nil, err
+		}
 	}
 
-	outputFile, err := os.OpenFile(out+"/cidata.iso", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	outputFile, err := os.OpenFile(out+"/seed.iso", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
 	}
 
-	err = writer.WriteTo(outputFile, "CIDATA")
+	err = writer.WriteTo(outputFile, label)
 	if err != nil {
 		return nil, err
 	}
@@ -128,13 +170,14 @@ DNS=` + i.Network.DNSServer.String(),
 		Pool:              i.Image.Pool,
 		Name:              fmt.Sprintf("%s-cloudinit", i.Name),
 		ImageLocationType: image.File,
-		ImageLocation:     out + "/cidata.iso",
+		ImageLocation:     out + "/seed.iso",
+		Format:            image.FormatRaw,
 	}
-	if err := img.Create(); err != nil {
+	if err := img.Create(l); err != nil {
 		return nil, err
 	}
 
-	newImg, err := image.Get(img.Name, img.Pool)
+	newImg, err := image.Get(l, img.Name, img.Pool)
 	if err != nil {
 		return nil, err
 	}
@@ -142,20 +185,27 @@ DNS=` + i.Network.DNSServer.String(),
 	return newImg, nil
 }
 
+// seedFile is a file on the seed volume, name is its path on the volume.
+type seedFile struct {
+	name    string
+	content []byte
+}
+
 type cloudInit struct {
-	Hostname       string       `yaml:"hostname"`
-	ManageEtcHosts bool         `yaml:"manage_etc_hosts"`
-	Users          []user       `yaml:"users"`
-	SSHPwauth      bool         `yaml:"ssh_pwauth"`
-	DisableRoot    bool         `yaml:"disable_root"`
-	Chpasswd       chpasswd     `yaml:"chpasswd"`
-	WriteFiles     []writeFiles `yaml:"write_files"`
-	RunCMD         []string     `yaml:"runcmd"`
+	Hostname         string       `yaml:"hostname"`
+	ManageEtcHosts   bool         `yaml:"manage_etc_hosts"`
+	Users            []user       `yaml:"users"`
+	SSHPwauth        bool         `yaml:"ssh_pwauth"`
+	DisableRoot      bool         `yaml:"disable_root"`
+	WriteFiles       []writeFiles `yaml:"write_files,omitempty"`
+	ManageResolvConf bool         `yaml:"manage_resolv_conf,omitempty"`
+	ResolvConf       *resolvConf  `yaml:"resolv_conf,omitempty"`
+	Packages         []string     `yaml:"packages,omitempty"`
+	RunCMD           []string     `yaml:"runcmd"`
 }
 
-type chpasswd struct {
-	List   string `yaml:"list"`
-	Expire bool   `yaml:"expire"`
+type resolvConf struct {
+	Nameservers []string `yaml:"nameservers"`
 }
 
 type writeFiles struct {
@@ -170,6 +220,7 @@ type user struct {
 	Home              string   `yaml:"home"`
 	Shell             string   `yaml:"shell"`
 	LockPasswd        bool     `yaml:"lock_passwd"`
+	Passwd            string   `yaml:"passwd,omitempty"`
 	SSHAuthorizedKeys []string `yaml:"ssh-authorized-keys"`
 }
 
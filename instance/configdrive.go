@@ -0,0 +1,103 @@
+package instance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// configDriveMetaData is openstack/latest/meta_data.json of a config drive.
+type configDriveMetaData struct {
+	UUID       string            `json:"uuid"`
+	Name       string            `json:"name"`
+	Hostname   string            `json:"hostname"`
+	PublicKeys map[string]string `json:"public_keys"`
+}
+
+// networkData is openstack/latest/network_data.json of a config drive.
+type networkData struct {
+	Links    []networkDataLink    `json:"links"`
+	Networks []networkDataNetwork `json:"networks"`
+	Services []networkDataService `json:"services,omitempty"`
+}
+
+type networkDataLink struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	EthernetMACAddress string `json:"ethernet_mac_address,omitempty"`
+}
+
+type networkDataNetwork struct {
+	ID        string             `json:"id"`
+	Type      string             `json:"type"`
+	Link      string             `json:"link"`
+	IPAddress string             `json:"ip_address,omitempty"`
+	Netmask   string             `json:"netmask,omitempty"`
+	Routes    []networkDataRoute `json:"routes,omitempty"`
+}
+
+type networkDataRoute struct {
+	Network string `json:"network"`
+	Netmask string `json:"netmask"`
+	Gateway string `json:"gateway"`
+}
+
+type networkDataService struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// configDriveMetaData renders the config drive meta data, the instance
+// name doubles as the instance id like in the NoCloud meta-data.
+func (i *Instance) configDriveMetaData() ([]byte, error) {
+	return json.MarshalIndent(&configDriveMetaData{
+		UUID:     i.Name,
+		Name:     i.Name,
+		Hostname: i.Name,
+		PublicKeys: map[string]string{
+			"gokvm": strings.TrimSpace(i.PubKey),
+		},
+	}, "", "  ")
+}
+
+// networkData renders the network config of the instance in the
+// OpenStack format, see networkConfig for the NoCloud one.
+func (i *Instance) networkData() ([]byte, error) {
+	data := networkData{}
+	nameservers := map[string]bool{}
+	for idx, attachment := range i.Networks {
+		link := fmt.Sprintf("eth%d", idx)
+		data.Links = append(data.Links, networkDataLink{
+			ID:                 link,
+			Type:               "phy",
+			EthernetMACAddress: attachment.MAC,
+		})
+		netw := networkDataNetwork{
+			ID:   fmt.Sprintf("network%d", idx),
+			Type: "ipv4_dhcp",
+			Link: link,
+		}
+		if attachment.IP != nil {
+			netw.Type = "ipv4"
+			netw.IPAddress = attachment.IP.String()
+			netw.Netmask = net.IP(attachment.Network.Subnet.Mask).String()
+			if idx == 0 && attachment.Network.Gateway != nil {
+				netw.Routes = []networkDataRoute{{
+					Network: "0.0.0.0",
+					Netmask: "0.0.0.0",
+					Gateway: attachment.Network.Gateway.String(),
+				}}
+			}
+			if nameserver := attachment.Network.Nameserver(); nameserver != nil && !nameservers[nameserver.String()] {
+				nameservers[nameserver.String()] = true
+				data.Services = append(data.Services, networkDataService{
+					Type:    "dns",
+					Address: nameserver.String(),
+				})
+			}
+		}
+		data.Networks = append(data.Networks, netw)
+	}
+	return json.MarshalIndent(&data, "", "  ")
+}
@@ -0,0 +1,91 @@
+package instance
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/michaelhenkel/gokvm/network"
+)
+
+func TestNetworkData(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.100.0/24")
+	_, storageSubnet, _ := net.ParseCIDR("10.0.0.0/16")
+	management := network.Network{Name: "static", Subnet: subnet, Gateway: net.ParseIP("192.168.100.1")}
+	inst := &Instance{
+		Name: "c-instance-0.test.local",
+		Networks: []NetworkAttachment{{
+			Network: management,
+			IP:      net.ParseIP("192.168.100.10"),
+			MAC:     "52:54:00:00:00:01",
+		}, {
+			Network: network.Network{Name: "dhcp"},
+			MAC:     "52:54:00:00:00:02",
+		}, {
+			Network: network.Network{Name: "storage", Subnet: storageSubnet, Gateway: net.ParseIP("10.0.0.1"), DNSServer: net.ParseIP("192.168.100.1")},
+			IP:      net.ParseIP("10.0.1.10"),
+			MAC:     "52:54:00:00:00:03",
+		}},
+	}
+	out, err := inst.networkData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data networkData
+	if err := json.Unmarshal(out, &data); err != nil {
+		t.Fatal(err)
+	}
+	want := networkData{
+		Links: []networkDataLink{
+			{ID: "eth0", Type: "phy", EthernetMACAddress: "52:54:00:00:00:01"},
+			{ID: "eth1", Type: "phy", EthernetMACAddress: "52:54:00:00:00:02"},
+			{ID: "eth2", Type: "phy", EthernetMACAddress: "52:54:00:00:00:03"},
+		},
+		Networks: []networkDataNetwork{{
+			ID:        "network0",
+			Type:      "ipv4",
+			Link:      "eth0",
+			IPAddress: "192.168.100.10",
+			Netmask:   "255.255.255.0",
+			Routes:    []networkDataRoute{{Network: "0.0.0.0", Netmask: "0.0.0.0", Gateway: "192.168.100.1"}},
+		}, {
+			ID:   "network1",
+			Type: "ipv4_dhcp",
+			Link: "eth1",
+		}, {
+			// only the management network has the default route
+			ID:        "network2",
+			Type:      "ipv4",
+			Link:      "eth2",
+			IPAddress: "10.0.1.10",
+			Netmask:   "255.255.0.0",
+		}},
+		// both static networks use the same nameserver, it is listed once
+		Services: []networkDataService{{Type: "dns", Address: "192.168.100.1"}},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got network data %s, want %+v", out, want)
+	}
+}
+
+func TestConfigDriveMetaData(t *testing.T) {
+	inst := &Instance{Name: "vm.test.local", PubKey: "ssh-ed25519 AAAA test\n"}
+	out, err := inst.configDriveMetaData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data configDriveMetaData
+	if err := json.Unmarshal(out, &data); err != nil {
+		t.Fatal(err)
+	}
+	want := configDriveMetaData{
+		UUID:       "vm.test.local",
+		Name:       "vm.test.local",
+		Hostname:   "vm.test.local",
+		PublicKeys: map[string]string{"gokvm": "ssh-ed25519 AAAA test"},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got meta data %s, want %+v", out, want)
+	}
+}
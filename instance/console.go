@@ -0,0 +1,66 @@
+package instance
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/michaelhenkel/gokvm/backend"
+)
+
+// Console connects in and out to the serial console of the running
+// instance. It returns when escape is read from in, in hits EOF or the
+// console is closed by the hypervisor.
+func (i *Instance) Console(l backend.Backend, in io.Reader, out io.Writer, escape byte, force bool) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	state, err := domain.State()
+	if err != nil {
+		return err
+	}
+	if state != backend.DomainRunning {
+		return fmt.Errorf("instance %s is %s", i.Name, state)
+	}
+	console, err := domain.OpenConsole(force)
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(out, console)
+		done <- err
+	}()
+	go func() {
+		done <- copyUntil(console, in, escape)
+	}()
+	return <-done
+}
+
+// copyUntil copies from src to dst until escape is read or src is
+// exhausted. Bytes read before the escape in the same chunk are written.
+func copyUntil(dst io.Writer, src io.Reader, escape byte) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := src.Read(buf)
+		for idx := 0; idx < n; idx++ {
+			if buf[idx] == escape {
+				_, werr := dst.Write(buf[:idx])
+				return werr
+			}
+		}
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package instance
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/config"
+	"gopkg.in/yaml.v3"
+)
+
+// PasswordPolicy decides how the password of the instance user is set.
+type PasswordPolicy string
+
+const (
+	// PasswordRandom generates a password per instance, it is kept in
+	// the credentials store and only its hash goes to the guest.
+	PasswordRandom PasswordPolicy = "random"
+	// PasswordHashed sets a crypt(3) hash given by the user.
+	PasswordHashed PasswordPolicy = "hashed"
+	// PasswordDisabled locks the password, only SSH keys log in.
+	PasswordDisabled PasswordPolicy = "disabled"
+)
+
+const randomPasswordLength = 20
+
+// Credentials control the logins cloud-init sets up on an instance.
+type Credentials struct {
+	// Password is the policy for the password of the instance user,
+	// PasswordRandom if empty.
+	Password PasswordPolicy
+	// PasswordHash is the hash set with PasswordHashed.
+	PasswordHash string
+	// RootLogin allows root to log in with the SSH key.
+	RootLogin bool
+	// SSHPasswordAuth enables password logins in sshd.
+	SSHPasswordAuth bool
+}
+
+// Password is a generated password as kept in the credentials store.
+type Password struct {
+	Instance string `yaml:"-"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+func (c Credentials) policy() PasswordPolicy {
+	if c.Password == "" {
+		return PasswordRandom
+	}
+	return c.Password
+}
+
+// Validate checks that the policy is known and comes with a hash if
+// PasswordHashed.
+func (c Credentials) Validate() error {
+	switch c.policy() {
+	case PasswordRandom, PasswordDisabled:
+		if c.PasswordHash != "" {
+			return fmt.Errorf("a password hash requires the %s password policy", PasswordHashed)
+		}
+	case PasswordHashed:
+		if !strings.HasPrefix(c.PasswordHash, "$") {
+			return fmt.Errorf("password hash must be in crypt(3) format, e.g. from mkpasswd -m sha-512")
+		}
+	default:
+		return fmt.Errorf("invalid password policy %q", c.Password)
+	}
+	return nil
+}
+
+// passwordHash returns the hash to set for the instance user, empty if
+// the password is disabled. A random password is stored before its hash
+// is returned, dry runs only generate it.
+func (i *Instance) passwordHash(l backend.Backend) (string, error) {
+	switch i.Credentials.policy() {
+	case PasswordHashed:
+		return i.Credentials.PasswordHash, nil
+	case PasswordRandom:
+		password, err := randomString(cryptAlphabet[2:], randomPasswordLength)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := l.(backend.Recorder); !ok {
+			if err := storePassword(l, i.ClusterName, i.Name, &Password{User: i.user(), Password: password}); err != nil {
+				return "", err
+			}
+		}
+		salt, err := randomString(cryptAlphabet, 16)
+		if err != nil {
+			return "", err
+		}
+		return sha512Crypt(password, salt), nil
+	}
+	return "", nil
+}
+
+// ListPasswords returns the generated passwords of the cluster instances
+// sorted by instance.
+func ListPasswords(l backend.Backend, cluster string) ([]Password, error) {
+	passwords, err := loadPasswords(l, cluster)
+	if err != nil {
+		return nil, err
+	}
+	var list []Password
+	for inst, password := range passwords {
+		password.Instance = inst
+		list = append(list, password)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Instance < list[b].Instance })
+	return list, nil
+}
+
+func RenderPasswords(passwords []Password) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Instance", "User", "Password"})
+	for _, password := range passwords {
+		t.AppendRow(table.Row{password.Instance, password.User, password.Password})
+	}
+	t.SetStyle(table.StyleLight)
+	t.Render()
+}
+
+// passwordFile returns the credentials store of cluster, clusters of the
+// same name on different hosts have their own.
+func passwordFile(l backend.Backend, cluster string) (string, error) {
+	uri, err := l.URI()
+	if err != nil {
+		return "", err
+	}
+	dir, err := config.HostDir(uri)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "credentials", cluster+".yaml"), nil
+}
+
+func loadPasswords(l backend.Backend, cluster string) (map[string]Password, error) {
+	path, err := passwordFile(l, cluster)
+	if err != nil {
+		return nil, err
+	}
+	passwords := make(map[string]Password)
+	f, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return passwords, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(f, &passwords); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return passwords, nil
+}
+
+// storePassword sets the password of inst in the cluster store, nil
+// removes it. The store is removed with its last password.
+func storePassword(l backend.Backend, cluster, inst string, password *Password) error {
+	passwords, err := loadPasswords(l, cluster)
+	if err != nil {
+		return err
+	}
+	path, err := passwordFile(l, cluster)
+	if err != nil {
+		return err
+	}
+	if password == nil {
+		if _, ok := passwords[inst]; !ok {
+			return nil
+		}
+		delete(passwords, inst)
+	} else {
+		passwords[inst] = *password
+	}
+	if len(passwords) == 0 {
+		return os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(passwords)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0600)
+}
@@ -0,0 +1,158 @@
+package instance
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/backend/dryrun"
+	"github.com/michaelhenkel/gokvm/backend/fake"
+)
+
+// tempHome points HOME to a temporary directory for the test.
+func tempHome(t *testing.T) {
+	t.Helper()
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", t.TempDir())
+	t.Cleanup(func() { os.Setenv("HOME", home) })
+}
+
+// otherHost is a fake backend connected to another host.
+type otherHost struct {
+	*fake.Backend
+}
+
+func (h otherHost) URI() (string, error) {
+	return "qemu+ssh://other/system", nil
+}
+
+func TestCredentialsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       Credentials
+		wantErr bool
+	}{
+		{"default", Credentials{}, false},
+		{"random", Credentials{Password: PasswordRandom}, false},
+		{"disabled", Credentials{Password: PasswordDisabled}, false},
+		{"hashed", Credentials{Password: PasswordHashed, PasswordHash: "$6$salt$hash"}, false},
+		{"hashed without hash", Credentials{Password: PasswordHashed}, true},
+		{"hashed plain text", Credentials{Password: PasswordHashed, PasswordHash: "secret"}, true},
+		{"random with hash", Credentials{PasswordHash: "$6$salt$hash"}, true},
+		{"disabled with hash", Credentials{Password: PasswordDisabled, PasswordHash: "$6$salt$hash"}, true},
+		{"unknown", Credentials{Password: "plain"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want an error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	tests := []struct {
+		name   string
+		c      Credentials
+		dryRun bool
+		// stored tells whether a random password is kept
+		stored bool
+		want   string
+	}{
+		{"random", Credentials{}, false, true, ""},
+		{"random dry run", Credentials{}, true, false, ""},
+		{"hashed", Credentials{Password: PasswordHashed, PasswordHash: "$6$salt$hash"}, false, false, "$6$salt$hash"},
+		{"disabled", Credentials{Password: PasswordDisabled}, false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempHome(t)
+			var l backend.Backend = fake.New()
+			if tt.dryRun {
+				l = dryrun.New(l, ioutil.Discard)
+			}
+			inst := &Instance{Name: "vm", ClusterName: "test", User: "admin", Credentials: tt.c}
+			hash, err := inst.passwordHash(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			passwords, err := ListPasswords(l, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inst.Credentials.policy() != PasswordRandom {
+				if hash != tt.want {
+					t.Errorf("got hash %q, want %q", hash, tt.want)
+				}
+			} else if !strings.HasPrefix(hash, "$6$") {
+				t.Errorf("got hash %q, want a SHA-512 crypt hash", hash)
+			}
+			if !tt.stored {
+				if len(passwords) != 0 {
+					t.Errorf("got stored passwords %v, want none", passwords)
+				}
+				path, err := passwordFile(l, "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("credentials file %s was written", path)
+				}
+				return
+			}
+			if len(passwords) != 1 || passwords[0].Instance != "vm" || passwords[0].User != "admin" {
+				t.Fatalf("got stored passwords %v, want one for admin on vm", passwords)
+			}
+			// the hash carries its salt after $6$
+			salt := strings.SplitN(hash, "$", 4)[2]
+			if got := sha512Crypt(passwords[0].Password, salt); got != hash {
+				t.Errorf("got hash %s, the stored password hashes to %s", hash, got)
+			}
+		})
+	}
+}
+
+func TestStorePassword(t *testing.T) {
+	tempHome(t)
+	l := fake.New()
+	other := otherHost{fake.New()}
+	for _, inst := range []string{"w-instance-0", "c-instance-0"} {
+		if err := storePassword(l, "test", inst, &Password{User: "admin", Password: inst + "-secret"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storePassword(other, "test", "c-instance-0", &Password{User: "admin", Password: "other-secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	passwords, err := ListPasswords(l, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 2 || passwords[0].Instance != "c-instance-0" || passwords[1].Instance != "w-instance-0" {
+		t.Fatalf("got passwords %v, want c-instance-0 and w-instance-0", passwords)
+	}
+	if passwords[0].Password != "c-instance-0-secret" {
+		t.Errorf("got password %s for c-instance-0, want the one of this host", passwords[0].Password)
+	}
+
+	for _, inst := range []string{"c-instance-0", "w-instance-0", "missing"} {
+		if err := storePassword(l, "test", inst, nil); err != nil {
+			t.Fatalf("removing %s: %s", inst, err)
+		}
+	}
+	path, err := passwordFile(l, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("credentials file %s is left without passwords", path)
+	}
+	if passwords, err = ListPasswords(other, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 1 || passwords[0].Password != "other-secret" {
+		t.Errorf("got passwords %v on the other host, want its own", passwords)
+	}
+}
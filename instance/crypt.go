@@ -0,0 +1,160 @@
+package instance
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	defaultCryptRounds = 5000
+	minCryptRounds     = 1000
+	maxCryptRounds     = 999999999
+)
+
+// sha512Crypt hashes password like crypt(3) with a "$6$" salt, the format
+// cloud-init passes to chpasswd/usermod. The salt may start with
+// "rounds=<n>$" to change the default 5000 rounds.
+func sha512Crypt(password, salt string) string {
+	rounds, customRounds := defaultCryptRounds, false
+	if strings.HasPrefix(salt, "rounds=") {
+		spec := strings.TrimPrefix(salt, "rounds=")
+		if idx := strings.Index(spec, "$"); idx > 0 {
+			if n, err := strconv.ParseUint(spec[:idx], 10, 64); err == nil {
+				rounds, customRounds = clampRounds(n), true
+				salt = spec[idx+1:]
+			}
+		}
+	}
+	if idx := strings.Index(salt, "$"); idx >= 0 {
+		salt = salt[:idx]
+	}
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	alternate := sha512.New()
+	alternate.Write(p)
+	alternate.Write(s)
+	alternate.Write(p)
+	b := alternate.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	i := len(p)
+	for ; i > sha512.Size; i -= sha512.Size {
+		a.Write(b)
+	}
+	a.Write(b[:i])
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(b)
+		} else {
+			a.Write(p)
+		}
+	}
+	c := a.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pSeq := repeat(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(c[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeat(ds.Sum(nil), len(s))
+
+	for i := 0; i < rounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := []byte("$6$")
+	if customRounds {
+		out = append(out, fmt.Sprintf("rounds=%d$", rounds)...)
+	}
+	out = append(out, salt+"$"...)
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+	for _, o := range order {
+		out = appendCrypt64(out, uint(c[o[0]])<<16|uint(c[o[1]])<<8|uint(c[o[2]]), 4)
+	}
+	out = appendCrypt64(out, uint(c[63]), 2)
+	return string(out)
+}
+
+func clampRounds(n uint64) int {
+	if n < minCryptRounds {
+		return minCryptRounds
+	}
+	if n > maxCryptRounds {
+		return maxCryptRounds
+	}
+	return int(n)
+}
+
+// repeat returns n bytes of digest repeated.
+func repeat(digest []byte, n int) []byte {
+	seq := make([]byte, 0, n)
+	for len(seq) < n {
+		rest := n - len(seq)
+		if rest > len(digest) {
+			rest = len(digest)
+		}
+		seq = append(seq, digest[:rest]...)
+	}
+	return seq
+}
+
+func appendCrypt64(out []byte, v uint, n int) []byte {
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+	return out
+}
+
+// randomString returns n characters drawn from alphabet by crypto/rand.
+func randomString(alphabet string, n int) (string, error) {
+	out := make([]byte, n)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range out {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		out[i] = alphabet[idx.Int64()]
+	}
+	return string(out), nil
+}
@@ -0,0 +1,98 @@
+package instance
+
+import (
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/image"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+func (i *Instance) dataDiskName(idx int) string {
+	return fmt.Sprintf("%s-data-%d", i.Name, idx)
+}
+
+// createDataDisks creates a blank qcow2 volume in the image pool for every
+// entry of Resources.DataDisks.
+func (i *Instance) createDataDisks(l backend.Backend) ([]*image.Image, error) {
+	var disks []*image.Image
+	if len(i.Resources.DataDisks) == 0 {
+		return disks, nil
+	}
+	pool, err := l.LookupStoragePool(i.Image.Pool)
+	if err != nil {
+		return nil, err
+	}
+	for idx, size := range i.Resources.DataDisks {
+		volName := i.dataDiskName(idx)
+		existingImg, err := image.Get(l, volName, i.Image.Pool)
+		if err != nil {
+			return nil, err
+		}
+		if existingImg != nil {
+			disks = append(disks, existingImg)
+			continue
+		}
+		diskSize, err := bytefmt.ToBytes(size)
+		if err != nil {
+			return nil, err
+		}
+		vol := libvirtxml.StorageVolume{
+			Name: volName,
+			Type: "file",
+			Capacity: &libvirtxml.StorageVolumeSize{
+				Unit:  "bytes",
+				Value: diskSize,
+			},
+			Target: &libvirtxml.StorageVolumeTarget{
+				Format: &libvirtxml.StorageVolumeTargetFormat{
+					Type: "qcow2",
+				},
+			},
+		}
+		volXML, err := vol.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pool.CreateVolume(volXML); err != nil {
+			return nil, err
+		}
+		img, err := image.Get(l, volName, i.Image.Pool)
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, img)
+	}
+	return disks, nil
+}
+
+// deleteDataDisks removes all data disk volumes of the instance.
+func (i *Instance) deleteDataDisks(l backend.Backend) error {
+	images, err := image.List(l, i.Image.Pool)
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("%s-data-", i.Name)
+	for _, img := range images {
+		if !strings.HasPrefix(img.Name, prefix) {
+			continue
+		}
+		if err := img.Delete(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diskDev returns the virtio device name for the disk at idx, vda being
+// the root disk.
+func diskDev(idx int) string {
+	name := ""
+	for idx++; idx > 0; idx = (idx - 1) / 26 {
+		name = string(rune('a'+(idx-1)%26)) + name
+	}
+	return "vd" + name
+}
@@ -0,0 +1,181 @@
+package instance
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/distro"
+	"github.com/michaelhenkel/gokvm/image"
+)
+
+const (
+	ignitionVersion = "3.3.0"
+	// ignitionFWCfgName is the fw_cfg key Ignition reads on QEMU.
+	ignitionFWCfgName = "opt/com.coreos/config"
+)
+
+type ignitionConfig struct {
+	Ignition ignitionMeta    `json:"ignition"`
+	Passwd   ignitionPasswd  `json:"passwd"`
+	Storage  ignitionStorage `json:"storage"`
+	Systemd  ignitionSystemd `json:"systemd"`
+}
+
+type ignitionMeta struct {
+	Version string              `json:"version"`
+	Config  *ignitionConfigRefs `json:"config,omitempty"`
+}
+
+type ignitionConfigRefs struct {
+	Merge []ignitionResource `json:"merge"`
+}
+
+type ignitionResource struct {
+	Source string `json:"source"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUser `json:"users,omitempty"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	PasswordHash      string   `json:"passwordHash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files,omitempty"`
+}
+
+type ignitionFile struct {
+	Path      string           `json:"path"`
+	Mode      int              `json:"mode"`
+	Overwrite bool             `json:"overwrite"`
+	Contents  ignitionResource `json:"contents"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units,omitempty"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents,omitempty"`
+}
+
+// createIgnition renders the Ignition config of the instance into a
+// volume, the domain passes it to the guest through fw_cfg. User-data
+// files must be Ignition configs, they are merged into the generated one.
+func (i *Instance) createIgnition(l backend.Backend, profile distro.Profile) (*image.Image, error) {
+	passwordHash, err := i.passwordHash(l)
+	if err != nil {
+		return nil, err
+	}
+	sshKey := strings.TrimSpace(i.PubKey)
+	config := ignitionConfig{
+		Ignition: ignitionMeta{Version: ignitionVersion},
+		Passwd: ignitionPasswd{
+			Users: []ignitionUser{{
+				Name:              i.user(),
+				PasswordHash:      passwordHash,
+				SSHAuthorizedKeys: []string{sshKey},
+			}},
+		},
+		Storage: ignitionStorage{
+			Files: []ignitionFile{
+				ignitionDataFile("/etc/hostname", 0644, i.Name+"\n"),
+				ignitionDataFile("/etc/sudoers.d/gokvm", 0440, i.user()+" ALL=(ALL) NOPASSWD:ALL\n"),
+			},
+		},
+	}
+	if i.Credentials.RootLogin {
+		config.Passwd.Users = append(config.Passwd.Users, ignitionUser{
+			Name:              "root",
+			SSHAuthorizedKeys: []string{sshKey},
+		})
+	}
+	if hosts := i.etcHosts(); hosts != "" {
+		config.Storage.Files = append(config.Storage.Files, ignitionDataFile("/etc/hosts", 0644, hosts))
+	}
+	var sshdConfig []string
+	if i.Credentials.SSHPasswordAuth {
+		sshdConfig = append(sshdConfig, "PasswordAuthentication yes")
+	}
+	if i.Credentials.RootLogin {
+		sshdConfig = append(sshdConfig, "PermitRootLogin prohibit-password")
+	}
+	if len(sshdConfig) > 0 {
+		config.Storage.Files = append(config.Storage.Files,
+			ignitionDataFile("/etc/ssh/sshd_config.d/40-gokvm.conf", 0644, strings.Join(sshdConfig, "\n")+"\n"))
+	}
+	if profile.AgentPackage != "" {
+		config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+			Name:    profile.AgentPackage + ".service",
+			Enabled: true,
+		})
+	}
+	for _, file := range i.UserData {
+		content, err := i.readUserData(file)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(content) {
+			return nil, fmt.Errorf("user-data %s is no Ignition config", file)
+		}
+		if config.Ignition.Config == nil {
+			config.Ignition.Config = &ignitionConfigRefs{}
+		}
+		config.Ignition.Config.Merge = append(config.Ignition.Config.Merge, ignitionResource{
+			Source: "data:;base64," + base64.StdEncoding.EncodeToString(content),
+		})
+	}
+
+	configJSON, err := json.MarshalIndent(&config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := l.(backend.Recorder); ok {
+		r.Record("ignition", i.Name, string(configJSON))
+	}
+
+	out, err := ioutil.TempDir("/tmp", "prefix")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(out)
+	configPath := out + "/config.ign"
+	if err := os.WriteFile(configPath, configJSON, 0600); err != nil {
+		return nil, err
+	}
+
+	img := &image.Image{
+		Pool:              i.Image.Pool,
+		Name:              fmt.Sprintf("%s-ignition", i.Name),
+		ImageLocationType: image.File,
+		ImageLocation:     configPath,
+		Format:            image.FormatRaw,
+	}
+	if err := img.Create(l); err != nil {
+		return nil, err
+	}
+	return image.Get(l, img.Name, img.Pool)
+}
+
+func ignitionDataFile(path string, mode int, content string) ignitionFile {
+	return ignitionFile{
+		Path:      path,
+		Mode:      mode,
+		Overwrite: true,
+		Contents: ignitionResource{
+			Source: "data:," + url.PathEscape(content),
+		},
+	}
+}
@@ -0,0 +1,140 @@
+package instance
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/michaelhenkel/gokvm/backend/fake"
+	"github.com/michaelhenkel/gokvm/distro"
+	"github.com/michaelhenkel/gokvm/image"
+)
+
+// ignitionFileContent decodes the contents of a file of the generated
+// config.
+func ignitionFileContent(t *testing.T, file ignitionFile) string {
+	t.Helper()
+	if !strings.HasPrefix(file.Contents.Source, "data:,") {
+		t.Fatalf("file %s has source %s, want a data URL", file.Path, file.Contents.Source)
+	}
+	content, err := url.PathUnescape(strings.TrimPrefix(file.Contents.Source, "data:,"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestCreateIgnition(t *testing.T) {
+	tempHome(t)
+	userData := `{"ignition": {"version": "3.3.0"}, "storage": {"files": [{"path": "/etc/motd"}]}}`
+	inst := &Instance{
+		Name:        "c-instance-0.test.local",
+		ClusterName: "test",
+		User:        "core",
+		PubKey:      "ssh-ed25519 AAAA test\n",
+		Image:       image.Image{Pool: "gokvm"},
+		Credentials: Credentials{Password: PasswordHashed, PasswordHash: "$6$salt$hash", RootLogin: true},
+		Networks:    []NetworkAttachment{{IP: net.ParseIP("192.168.100.10")}},
+		Peers:       []Peer{{Name: "w-instance-0.test.local", Role: Worker, Address: net.ParseIP("192.168.100.11")}},
+		UserData:    writeUserData(t, map[string]string{"extra.ign": userData}),
+	}
+	l := fake.New()
+	img, err := inst.createIgnition(l, distro.Profile{AgentPackage: "qemu-guest-agent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := l.LookupStoragePool(img.Pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := pool.LookupVolume(img.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ignitionConfig
+	if err := json.Unmarshal(vol.(*fake.StorageVolume).Data(), &config); err != nil {
+		t.Fatalf("volume %s holds no JSON: %s", img.Name, err)
+	}
+
+	if config.Ignition.Version != ignitionVersion {
+		t.Errorf("got version %s, want %s", config.Ignition.Version, ignitionVersion)
+	}
+	users := config.Passwd.Users
+	if len(users) != 2 || users[0].Name != "core" || users[1].Name != "root" {
+		t.Fatalf("got users %+v, want core and root", users)
+	}
+	if users[0].PasswordHash != "$6$salt$hash" || users[1].PasswordHash != "" {
+		t.Errorf("got password hashes %q and %q, want only the one of core", users[0].PasswordHash, users[1].PasswordHash)
+	}
+	for _, user := range users {
+		if len(user.SSHAuthorizedKeys) != 1 || user.SSHAuthorizedKeys[0] != "ssh-ed25519 AAAA test" {
+			t.Errorf("got keys %q for %s, want the trimmed public key", user.SSHAuthorizedKeys, user.Name)
+		}
+	}
+
+	files := map[string]ignitionFile{}
+	for _, file := range config.Storage.Files {
+		files[file.Path] = file
+	}
+	wantFiles := []struct {
+		path    string
+		mode    int
+		content string
+	}{
+		{"/etc/hostname", 0644, "c-instance-0.test.local\n"},
+		{"/etc/sudoers.d/gokvm", 0440, "core ALL=(ALL) NOPASSWD:ALL\n"},
+		{"/etc/ssh/sshd_config.d/40-gokvm.conf", 0644, "PermitRootLogin prohibit-password\n"},
+	}
+	for _, want := range wantFiles {
+		file, ok := files[want.path]
+		if !ok {
+			t.Errorf("file %s is missing", want.path)
+			continue
+		}
+		if file.Mode != want.mode || !file.Overwrite {
+			t.Errorf("file %s has mode %o and overwrite %t, want %o and true", want.path, file.Mode, file.Overwrite, want.mode)
+		}
+		if content := ignitionFileContent(t, file); content != want.content {
+			t.Errorf("file %s has content %q, want %q", want.path, content, want.content)
+		}
+	}
+	if hosts, ok := files["/etc/hosts"]; !ok {
+		t.Error("file /etc/hosts is missing")
+	} else if content := ignitionFileContent(t, hosts); !strings.Contains(content, "192.168.100.11 w-instance-0.test.local w-instance-0\n") {
+		t.Errorf("got /etc/hosts %q, want the worker peer", content)
+	}
+
+	if units := config.Systemd.Units; len(units) != 1 || units[0].Name != "qemu-guest-agent.service" || !units[0].Enabled {
+		t.Errorf("got units %+v, want the enabled guest agent", units)
+	}
+	if config.Ignition.Config == nil || len(config.Ignition.Config.Merge) != 1 {
+		t.Fatalf("got config %+v, want the user-data merged", config.Ignition.Config)
+	}
+	source := config.Ignition.Config.Merge[0].Source
+	if !strings.HasPrefix(source, "data:;base64,") {
+		t.Fatalf("got merge source %s, want a base64 data URL", source)
+	}
+	merged, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(source, "data:;base64,"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(merged) != userData {
+		t.Errorf("got merged config %s, want %s", merged, userData)
+	}
+}
+
+func TestCreateIgnitionInvalidUserData(t *testing.T) {
+	tempHome(t)
+	inst := &Instance{
+		Name:        "vm",
+		Image:       image.Image{Pool: "gokvm"},
+		Credentials: Credentials{Password: PasswordDisabled},
+		UserData:    writeUserData(t, map[string]string{"extra.cfg": "#cloud-config\npackages: [jq]\n"}),
+	}
+	if _, err := inst.createIgnition(fake.New(), distro.Profile{}); err == nil {
+		t.Error("a cloud-config was accepted as Ignition config")
+	}
+}
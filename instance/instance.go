@@ -2,14 +2,16 @@ package instance
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/distro"
 	"github.com/michaelhenkel/gokvm/image"
 	"github.com/michaelhenkel/gokvm/metadata"
 	"github.com/michaelhenkel/gokvm/network"
-	"github.com/michaelhenkel/gokvm/qemu"
-
-	"libvirt.org/libvirt-go"
 
+	log "github.com/sirupsen/logrus"
 	libvirtxml "libvirt.org/libvirt-go-xml"
 )
 
@@ -19,24 +21,69 @@ type Instance struct {
 	Resources   Resources
 	PubKey      string
 	DNSServer   string
-	Network     network.Network
+	Networks    []NetworkAttachment
 	ClusterName string
 	Suffix      string
+	Interfaces  []Interface
+	State       backend.DomainState
+	// Platform is detected once for all instances of a cluster, Create
+	// only detects it while the architecture is unknown.
+	Platform Platform
+	Role     Role
+	// Index is the position of the instance among the instances of its
+	// role, starting at 0.
+	Index int
+	// Peers are the other members of the cluster, user-data templates
+	// and /etc/hosts refer to them.
+	Peers []Peer
+	// User is the login created by cloud-init, the default user of the
+	// image distro if empty.
+	User        string
+	Credentials Credentials
+	// SSHKey is the path of the private key matching PubKey.
+	SSHKey string
+	// UserData are paths of user-data files merged into the generated
+	// cloud-config in order, they are rendered as templates first, see
+	// templateData.
+	UserData []string
+	// DomainTemplate is the path of a text/template rendering the domain
+	// XML skeleton. The embedded domainModel is used if empty.
+	DomainTemplate string
+	// Distro is the name of the distro profile the instance was created
+	// from.
+	Distro string
+}
+
+// NetworkAttachment is a NIC of the instance. The first attachment is
+// the management network. MAC and Model are optional, Model defaults to
+// virtio. A NIC with IP set is configured statically, otherwise by DHCP.
+type NetworkAttachment struct {
+	Network network.Network
+	MAC     string
+	Model   string
+	IP      net.IP
+}
+
+// Interface is a NIC as reported for an existing instance.
+type Interface struct {
+	Network     string
+	MAC         string
 	IPAddresses []string
 }
 
 type Resources struct {
-	CPU    int
-	Memory uint64
-	Disk   string
+	CPU       int
+	Memory    uint64
+	Disk      string
+	DataDisks []string
 }
 
 func getUintPtr(in uint) *uint {
 	return &in
 }
 
-func Get(name string, clusterName string) (*Instance, error) {
-	instances, err := List(clusterName)
+func Get(l backend.Backend, name string, clusterName string) (*Instance, error) {
+	instances, err := List(l, clusterName)
 	if err != nil {
 		return nil, err
 	}
@@ -48,17 +95,13 @@ func Get(name string, clusterName string) (*Instance, error) {
 	return nil, nil
 }
 
-func (i *Instance) Delete() error {
-	inst, err := Get(i.Name, i.ClusterName)
+func (i *Instance) Delete(l backend.Backend) error {
+	inst, err := Get(l, i.Name, i.ClusterName)
 	if err != nil {
 		return err
 	}
 	if inst != nil {
-		l, err := qemu.Connnect()
-		if err != nil {
-			return err
-		}
-		domain, err := l.LookupDomainByName(i.Name)
+		domain, err := l.LookupDomain(i.Name)
 		if err != nil {
 			return err
 		}
@@ -71,41 +114,96 @@ func (i *Instance) Delete() error {
 				return err
 			}
 		}
+		// libvirt refuses to undefine a domain with snapshot metadata
+		snaps, err := domain.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, snap := range snaps {
+			if err := snap.Delete(); err != nil {
+				return err
+			}
+		}
 		if err := domain.Undefine(); err != nil {
 			return err
 		}
-		img, err := image.Get(i.Name, i.Image.Pool)
+		if err := inst.releaseAddresses(l); err != nil {
+			return err
+		}
+		if err := storePassword(l, inst.ClusterName, inst.Name, nil); err != nil {
+			return err
+		}
+		img, err := image.Get(l, i.Name, i.Image.Pool)
 		if err != nil {
 			return err
 		}
 		if img != nil {
-			if err := img.Delete(); err != nil {
+			if err := img.Delete(l); err != nil {
 				return err
 			}
 		}
-		cloudInitImg, err := image.Get(fmt.Sprintf("%s-cloudinit", i.Name), i.Image.Pool)
-		if err != nil {
-			return err
-		}
-		if cloudInitImg != nil {
-			if err := cloudInitImg.Delete(); err != nil {
+		for _, seed := range []string{"cloudinit", "ignition"} {
+			seedImg, err := image.Get(l, fmt.Sprintf("%s-%s", i.Name, seed), i.Image.Pool)
+			if err != nil {
 				return err
 			}
+			if seedImg != nil {
+				if err := seedImg.Delete(l); err != nil {
+					return err
+				}
+			}
+		}
+		if err := i.deleteDataDisks(l); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (i *Instance) Create() error {
-	cloudInitImg, err := i.createCloudInit()
+func (i *Instance) Create(l backend.Backend) (err error) {
+	if len(i.Networks) == 0 {
+		return fmt.Errorf("instance %s has no network", i.Name)
+	}
+	profile, err := i.Image.Profile()
+	if err != nil {
+		return err
+	}
+	if i.User == "" {
+		i.User = profile.DefaultUser
+	}
+	i.Distro = profile.Name()
+	i.assignMACs()
+	existingVolumes, err := i.volumes(l)
 	if err != nil {
 		return err
 	}
-	img, err := i.createInstanceImage()
+	if err := i.reserveAddresses(l); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			i.deleteNewVolumes(l, existingVolumes)
+			i.unreserveAddresses(l)
+		}
+	}()
+	var seedImg *image.Image
+	if profile.Provisioner == distro.Ignition {
+		seedImg, err = i.createIgnition(l, profile)
+	} else {
+		seedImg, err = i.createCloudInit(l, profile)
+	}
 	if err != nil {
 		return err
 	}
-	baseImg, err := image.Get(i.Image.Name, i.Image.Pool)
+	img, err := i.createInstanceImage(l)
+	if err != nil {
+		return err
+	}
+	dataDisks, err := i.createDataDisks(l)
+	if err != nil {
+		return err
+	}
+	baseImg, err := image.Get(l, i.Image.Name, i.Image.Pool)
 	if err != nil {
 		return err
 	}
@@ -113,10 +211,27 @@ func (i *Instance) Create() error {
 	//subnetString := fmt.Sprintf("%s/%s", i.Network.Subnet.IP.String(), i.Network.Subnet.Mask.String())
 	m := &metadata.Metadata{
 		Cluster: &i.ClusterName,
+		Instance: &metadata.Instance{
+			Role:   string(i.Role),
+			User:   i.user(),
+			SSHKey: i.SSHKey,
+			Distro: i.Distro,
+		},
+	}
+	if profile.OSInfoID != "" {
+		m.OSInfo = metadata.NewOSInfo(profile.OSInfoID)
+	}
+	for _, attachment := range i.Networks {
+		if attachment.IP != nil {
+			m.Instance.Addresses = append(m.Instance.Addresses, metadata.Address{
+				MAC: attachment.MAC,
+				IP:  attachment.IP.String(),
+			})
+		}
 	}
 	domainMetadata := m.InstanceMetadata()
 
-	defaultDomain, err := defaultDomain()
+	defaultDomain, err := i.domainSkeleton()
 	if err != nil {
 		return err
 	}
@@ -133,50 +248,39 @@ func (i *Instance) Create() error {
 		Placement: "static",
 		Value:     uint(i.Resources.CPU),
 	}
-	defaultDomain.OS = &libvirtxml.DomainOS{
-		Type: &libvirtxml.DomainOSType{
-			Arch:    "x86_64",
-			Machine: "pc-q35-rhel8.2.0",
-			Type:    "hvm",
-		},
+	platform := i.Platform
+	if platform.Arch == "" {
+		if platform, err = DetectPlatform(l, platform); err != nil {
+			return err
+		}
 	}
-
-	defaultDomain.CPU = &libvirtxml.DomainCPU{
-		Mode:  "custom",
-		Match: "exact",
-		Check: "full",
+	defaultDomain.Type = platform.DomainType
+	if defaultDomain.OS == nil {
+		defaultDomain.OS = &libvirtxml.DomainOS{}
 	}
-	defaultDomain.Devices.Emulator = "/usr/local/bin/qemu-system-x86_64"
-	cdrom := libvirtxml.DomainDisk{
-		Device: "cdrom",
-		Driver: &libvirtxml.DomainDiskDriver{
-			Name: "qemu",
-			Type: "raw",
-		},
-		Source: &libvirtxml.DomainDiskSource{
-			File: &libvirtxml.DomainDiskSourceFile{
-				File: cloudInitImg.Path,
-			},
-			Index: 2,
-		},
-		Target: &libvirtxml.DomainDiskTarget{
-			Dev: "sda",
-			Bus: "sata",
-		},
-		ReadOnly: &libvirtxml.DomainDiskReadOnly{},
-		Alias: &libvirtxml.DomainAlias{
-			Name: "sata0-0-0",
-		},
-		Address: &libvirtxml.DomainAddress{
-			Drive: &libvirtxml.DomainAddressDrive{
-				Controller: getUintPtr(0),
-				Bus:        getUintPtr(0),
-				Target:     getUintPtr(0),
-				Unit:       getUintPtr(0),
+	defaultDomain.OS.Type = &libvirtxml.DomainOSType{
+		Arch:    platform.Arch,
+		Machine: platform.Machine,
+		Type:    "hvm",
+	}
+	defaultDomain.CPU = platform.domainCPU()
+	defaultDomain.Devices.Emulator = platform.Emulator
+	pciAllocator, err := newPCIAllocator(defaultDomain)
+	if err != nil {
+		return err
+	}
+	if profile.Provisioner == distro.Ignition {
+		defaultDomain.SysInfo = append(defaultDomain.SysInfo, libvirtxml.DomainSysInfo{
+			FWCfg: &libvirtxml.DomainSysInfoFWCfg{
+				Entry: []libvirtxml.DomainSysInfoEntry{{
+					Name: ignitionFWCfgName,
+					File: seedImg.Path,
+				}},
 			},
-		},
+		})
+	} else {
+		defaultDomain.Devices.Disks = append(defaultDomain.Devices.Disks, seedDisk(seedImg.Path))
 	}
-	defaultDomain.Devices.Disks = append(defaultDomain.Devices.Disks, cdrom)
 	disk := libvirtxml.DomainDisk{
 		Device: "disk",
 		Driver: &libvirtxml.DomainDiskDriver{
@@ -190,7 +294,7 @@ func (i *Instance) Create() error {
 		},
 		BackingStore: &libvirtxml.DomainDiskBackingStore{
 			Format: &libvirtxml.DomainDiskFormat{
-				Type: "qcow2",
+				Type: baseImg.BackingFormat(),
 			},
 			Source: &libvirtxml.DomainDiskSource{
 				File: &libvirtxml.DomainDiskSourceFile{
@@ -205,48 +309,67 @@ func (i *Instance) Create() error {
 		Alias: &libvirtxml.DomainAlias{
 			Name: "virtio-disk0",
 		},
-
-		Address: &libvirtxml.DomainAddress{
-			PCI: &libvirtxml.DomainAddressPCI{
-				Domain:   getUintPtr(0),
-				Bus:      getUintPtr(3),
-				Slot:     getUintPtr(0),
-				Function: getUintPtr(0),
-			},
-		},
+	}
+	if disk.Address, err = pciAllocator.allocate(); err != nil {
+		return err
 	}
 	defaultDomain.Devices.Disks = append(defaultDomain.Devices.Disks, disk)
-	networkInterface := libvirtxml.DomainInterface{
-		Model: &libvirtxml.DomainInterfaceModel{
-			Type: "virtio",
-		},
-		Address: &libvirtxml.DomainAddress{
-			PCI: &libvirtxml.DomainAddressPCI{
-				Domain:   getUintPtr(0),
-				Bus:      getUintPtr(1),
-				Slot:     getUintPtr(0),
-				Function: getUintPtr(0),
+	for idx, dataDisk := range dataDisks {
+		dataDiskAddress, err := pciAllocator.allocate()
+		if err != nil {
+			return err
+		}
+		defaultDomain.Devices.Disks = append(defaultDomain.Devices.Disks, libvirtxml.DomainDisk{
+			Device: "disk",
+			Driver: &libvirtxml.DomainDiskDriver{
+				Name: "qemu",
+				Type: "qcow2",
 			},
-		},
-		Source: &libvirtxml.DomainInterfaceSource{
-			Network: &libvirtxml.DomainInterfaceSourceNetwork{
-				Network: i.Network.Name,
-				Bridge:  i.Network.Bridge,
+			Source: &libvirtxml.DomainDiskSource{
+				File: &libvirtxml.DomainDiskSourceFile{
+					File: dataDisk.Path,
+				},
 			},
-		},
+			Target: &libvirtxml.DomainDiskTarget{
+				Dev: diskDev(idx + 1),
+				Bus: "virtio",
+			},
+			Address: dataDiskAddress,
+		})
 	}
 	var domainInterfaces []libvirtxml.DomainInterface
-	domainInterfaces = append(domainInterfaces, networkInterface)
+	for _, attachment := range i.Networks {
+		model := attachment.Model
+		if model == "" {
+			model = "virtio"
+		}
+		networkInterface := libvirtxml.DomainInterface{
+			Model: &libvirtxml.DomainInterfaceModel{
+				Type: model,
+			},
+			Source: &libvirtxml.DomainInterfaceSource{
+				Network: &libvirtxml.DomainInterfaceSourceNetwork{
+					Network: attachment.Network.Name,
+					Bridge:  attachment.Network.Bridge,
+				},
+			},
+		}
+		if attachment.MAC != "" {
+			networkInterface.MAC = &libvirtxml.DomainInterfaceMAC{
+				Address: attachment.MAC,
+			}
+		}
+		if networkInterface.Address, err = pciAllocator.allocate(); err != nil {
+			return err
+		}
+		domainInterfaces = append(domainInterfaces, networkInterface)
+	}
 	defaultDomain.Devices.Interfaces = domainInterfaces
 
 	domainXML, err := defaultDomain.Marshal()
 	if err != nil {
 		return err
 	}
-	l, err := qemu.Connnect()
-	if err != nil {
-		return err
-	}
 	/*
 		var testDomain libvirtxml.Domain
 		if err := testDomain.Unmarshal(dm); err != nil {
@@ -264,10 +387,18 @@ func (i *Instance) Create() error {
 			return err
 		}
 	*/
-	ldom, err := l.DomainDefineXML(domainXML)
+	ldom, err := l.DefineDomain(domainXML)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		// the volumes are deleted next, the domain must not outlive them
+		if err != nil {
+			if uerr := ldom.Undefine(); uerr != nil {
+				log.Errorf("failed to undefine %s: %s", i.Name, uerr)
+			}
+		}
+	}()
 	if err := ldom.SetAutostart(true); err != nil {
 		return err
 	}
@@ -278,18 +409,86 @@ func (i *Instance) Create() error {
 	return nil
 }
 
-func List(cluster string) ([]*Instance, error) {
-	l, err := qemu.Connnect()
+// volumes returns the names of the volumes of the instance in the image
+// pool: its root disk, seed and data disks.
+func (i *Instance) volumes(l backend.Backend) (map[string]bool, error) {
+	images, err := image.List(l, i.Image.Pool)
 	if err != nil {
 		return nil, err
 	}
-	domains, err := l.ListAllDomains(0)
+	names := map[string]bool{}
+	for _, img := range images {
+		switch {
+		case img.Name == i.Name,
+			img.Name == i.Name+"-cloudinit",
+			img.Name == i.Name+"-ignition",
+			strings.HasPrefix(img.Name, i.Name+"-data-"):
+			names[img.Name] = true
+		}
+	}
+	return names, nil
+}
+
+// deleteNewVolumes removes the volumes of an instance that failed to be
+// created, except for the existing ones. Errors are only logged.
+func (i *Instance) deleteNewVolumes(l backend.Backend, existing map[string]bool) {
+	names, err := i.volumes(l)
+	if err != nil {
+		log.Errorf("failed to list the volumes of %s: %s", i.Name, err)
+		return
+	}
+	for name := range names {
+		if existing[name] {
+			continue
+		}
+		img := &image.Image{Name: name, Pool: i.Image.Pool}
+		if err := img.Delete(l); err != nil {
+			log.Errorf("failed to delete volume %s: %s", name, err)
+		}
+	}
+}
+
+// seedDisk is the CD-ROM carrying the cloud-init seed.
+func seedDisk(path string) libvirtxml.DomainDisk {
+	return libvirtxml.DomainDisk{
+		Device: "cdrom",
+		Driver: &libvirtxml.DomainDiskDriver{
+			Name: "qemu",
+			Type: "raw",
+		},
+		Source: &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{
+				File: path,
+			},
+			Index: 2,
+		},
+		Target: &libvirtxml.DomainDiskTarget{
+			Dev: "sda",
+			Bus: "sata",
+		},
+		ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+		Alias: &libvirtxml.DomainAlias{
+			Name: "sata0-0-0",
+		},
+		Address: &libvirtxml.DomainAddress{
+			Drive: &libvirtxml.DomainAddressDrive{
+				Controller: getUintPtr(0),
+				Bus:        getUintPtr(0),
+				Target:     getUintPtr(0),
+				Unit:       getUintPtr(0),
+			},
+		},
+	}
+}
+
+func List(l backend.Backend, cluster string) ([]*Instance, error) {
+	domains, err := l.ListDomains()
 	if err != nil {
 		return nil, err
 	}
 	var instanceList []*Instance
 	for _, domain := range domains {
-		domainXML, err := domain.GetXMLDesc(0)
+		domainXML, err := domain.XML()
 		if err != nil {
 			return nil, err
 		}
@@ -310,7 +509,7 @@ func List(cluster string) ([]*Instance, error) {
 		if *md.Cluster != cluster && cluster != "" {
 			continue
 		}
-		inst, err := domainToInstance(domain, *md.Cluster)
+		inst, err := domainToInstance(domain, &xmlDomain, md)
 		if err != nil {
 			return nil, err
 		}
@@ -319,27 +518,105 @@ func List(cluster string) ([]*Instance, error) {
 	return instanceList, nil
 }
 
-func domainToInstance(domain libvirt.Domain, cluster string) (*Instance, error) {
-	instName, err := domain.GetName()
+func domainToInstance(domain backend.Domain, xmlDomain *libvirtxml.Domain, md *metadata.Metadata) (*Instance, error) {
+	instName, err := domain.Name()
 	if err != nil {
 		return nil, err
 	}
-	intfList, err := domain.ListAllInterfaceAddresses(0)
+	state, err := domain.State()
 	if err != nil {
 		return nil, err
 	}
-	var ipaddresses []string
-	for _, intf := range intfList {
-		for _, addr := range intf.Addrs {
-			ipaddresses = append(ipaddresses, addr.Addr)
+	active, err := domain.IsActive()
+	if err != nil {
+		return nil, err
+	}
+	addressMap := make(map[string][]string)
+	if active {
+		intfList, err := domain.InterfaceAddresses(backend.AddressesFromLease)
+		if err != nil {
+			return nil, err
+		}
+		addInterfaceAddresses(addressMap, intfList)
+	}
+	var interfaces []Interface
+	if xmlDomain.Devices != nil {
+		for _, domainInterface := range xmlDomain.Devices.Interfaces {
+			intf := Interface{}
+			if domainInterface.MAC != nil {
+				intf.MAC = strings.ToLower(domainInterface.MAC.Address)
+			}
+			if domainInterface.Source != nil && domainInterface.Source.Network != nil {
+				intf.Network = domainInterface.Source.Network.Network
+			}
+			intf.IPAddresses = addressMap[intf.MAC]
+			interfaces = append(interfaces, intf)
+		}
+	}
+	// Networks without libvirt DHCP have no leases, the guest agent knows
+	// the addresses if it runs.
+	if active && missingAddresses(interfaces) {
+		if intfList, err := domain.InterfaceAddresses(backend.AddressesFromAgent); err == nil {
+			agentAddresses := make(map[string][]string)
+			addInterfaceAddresses(agentAddresses, intfList)
+			for idx := range interfaces {
+				if len(interfaces[idx].IPAddresses) == 0 {
+					interfaces[idx].IPAddresses = agentAddresses[interfaces[idx].MAC]
+				}
+			}
+		}
+	}
+	// Static addresses are known without asking anyone.
+	if md.Instance != nil {
+		for idx := range interfaces {
+			if len(interfaces[idx].IPAddresses) > 0 {
+				continue
+			}
+			for _, addr := range md.Instance.Addresses {
+				if strings.ToLower(addr.MAC) == interfaces[idx].MAC {
+					interfaces[idx].IPAddresses = append(interfaces[idx].IPAddresses, addr.IP)
+				}
+			}
 		}
 	}
 
-	return &Instance{
+	inst := &Instance{
 		Name:        instName,
-		ClusterName: cluster,
-		IPAddresses: ipaddresses,
-	}, nil
+		ClusterName: *md.Cluster,
+		Interfaces:  interfaces,
+		State:       state,
+	}
+	if md.Instance != nil {
+		inst.Role = Role(md.Instance.Role)
+		inst.User = md.Instance.User
+		inst.SSHKey = md.Instance.SSHKey
+		inst.Distro = md.Instance.Distro
+	}
+	return inst, nil
+}
+
+func missingAddresses(interfaces []Interface) bool {
+	for _, intf := range interfaces {
+		if len(intf.IPAddresses) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// addInterfaceAddresses adds the addresses of intfList to addressMap keyed
+// by lower case MAC, loopback and link-local addresses are left out.
+func addInterfaceAddresses(addressMap map[string][]string, intfList []backend.Interface) {
+	for _, intf := range intfList {
+		mac := strings.ToLower(intf.Hwaddr)
+		for _, addr := range intf.Addrs {
+			ip := net.ParseIP(addr)
+			if ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+				continue
+			}
+			addressMap[mac] = append(addressMap[mac], addr)
+		}
+	}
 }
 
 func defaultDomain() (*libvirtxml.Domain, error) {
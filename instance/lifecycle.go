@@ -0,0 +1,99 @@
+package instance
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Start boots the instance if it is not running.
+func (i *Instance) Start(l backend.Backend) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		return nil
+	}
+	return domain.Create()
+}
+
+// Stop shuts the instance down gracefully and destroys it if it is still
+// running after timeout.
+func (i *Instance) Stop(l backend.Backend, timeout time.Duration) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+	if !active {
+		return nil
+	}
+	if err := domain.Shutdown(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		active, err := domain.IsActive()
+		if err != nil {
+			return err
+		}
+		if !active {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	log.Infof("%s did not shut down within %s, destroying it", i.Name, timeout)
+	return domain.Destroy()
+}
+
+func (i *Instance) Reboot(l backend.Backend) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	return domain.Reboot()
+}
+
+func (i *Instance) Suspend(l backend.Backend) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	state, err := domain.State()
+	if err != nil {
+		return err
+	}
+	if state == backend.DomainPaused {
+		return nil
+	}
+	if state != backend.DomainRunning {
+		return fmt.Errorf("cannot suspend %s in state %s", i.Name, state)
+	}
+	return domain.Suspend()
+}
+
+func (i *Instance) Resume(l backend.Backend) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	state, err := domain.State()
+	if err != nil {
+		return err
+	}
+	if state != backend.DomainPaused {
+		return nil
+	}
+	return domain.Resume()
+}
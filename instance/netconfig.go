@@ -0,0 +1,146 @@
+package instance
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/network"
+	"gopkg.in/yaml.v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// networkConfig is a cloud-init network config version 2.
+type networkConfig struct {
+	Version   int                       `yaml:"version"`
+	Ethernets map[string]ethernetConfig `yaml:"ethernets"`
+}
+
+type ethernetConfig struct {
+	Match       matchConfig       `yaml:"match"`
+	SetName     string            `yaml:"set-name"`
+	DHCP4       bool              `yaml:"dhcp4"`
+	Addresses   []string          `yaml:"addresses,omitempty"`
+	Gateway4    string            `yaml:"gateway4,omitempty"`
+	Nameservers *nameserverConfig `yaml:"nameservers,omitempty"`
+}
+
+type matchConfig struct {
+	MACAddress string `yaml:"macaddress"`
+}
+
+type nameserverConfig struct {
+	Addresses []string `yaml:"addresses"`
+}
+
+// hasStaticAddress reports whether any NIC of the instance has a static
+// address.
+func (i *Instance) hasStaticAddress() bool {
+	for _, attachment := range i.Networks {
+		if attachment.IP != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// assignMACs gives NICs without a MAC a MAC derived from the instance
+// name, the network config matches all NICs by MAC.
+func (i *Instance) assignMACs() {
+	for idx := range i.Networks {
+		if i.Networks[idx].MAC == "" {
+			i.Networks[idx].MAC = generateMAC(i.Name, idx)
+		}
+	}
+}
+
+// generateMAC returns a locally administered MAC in the QEMU range.
+func generateMAC(name string, idx int) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d", name, idx)
+	sum := h.Sum32()
+	return net.HardwareAddr{0x52, 0x54, 0x00, byte(sum >> 16), byte(sum >> 8), byte(sum)}.String()
+}
+
+// networkConfig renders the network config of the instance. NICs without
+// a static address use DHCP, only the first NIC gets the default route.
+func (i *Instance) networkConfig() ([]byte, error) {
+	config := networkConfig{
+		Version:   2,
+		Ethernets: make(map[string]ethernetConfig),
+	}
+	for idx, attachment := range i.Networks {
+		name := fmt.Sprintf("eth%d", idx)
+		ethernet := ethernetConfig{
+			Match:   matchConfig{MACAddress: attachment.MAC},
+			SetName: name,
+			DHCP4:   attachment.IP == nil,
+		}
+		if attachment.IP != nil {
+			prefix, _ := attachment.Network.Subnet.Mask.Size()
+			ethernet.Addresses = []string{fmt.Sprintf("%s/%d", attachment.IP, prefix)}
+			if idx == 0 && attachment.Network.Gateway != nil {
+				ethernet.Gateway4 = attachment.Network.Gateway.String()
+			}
+			if nameserver := attachment.Network.Nameserver(); nameserver != nil {
+				ethernet.Nameservers = &nameserverConfig{
+					Addresses: []string{nameserver.String()},
+				}
+			}
+		}
+		config.Ethernets[name] = ethernet
+	}
+	return yaml.Marshal(&config)
+}
+
+// reserveAddresses reserves the static addresses in the DHCP config of
+// their networks, on error none stays reserved.
+func (i *Instance) reserveAddresses(l backend.Backend) error {
+	for idx := range i.Networks {
+		attachment := &i.Networks[idx]
+		if attachment.IP == nil {
+			continue
+		}
+		if err := attachment.Network.Reserve(l, attachment.MAC, attachment.IP); err != nil {
+			i.unreserveAddresses(l)
+			return err
+		}
+	}
+	return nil
+}
+
+// unreserveAddresses undoes reserveAddresses for an instance that failed
+// to be created, errors are only logged.
+func (i *Instance) unreserveAddresses(l backend.Backend) {
+	for idx := range i.Networks {
+		attachment := &i.Networks[idx]
+		if attachment.IP == nil {
+			continue
+		}
+		if err := attachment.Network.Release(l, attachment.MAC); err != nil {
+			log.Errorf("failed to release %s of %s: %s", attachment.IP, i.Name, err)
+		}
+	}
+}
+
+// releaseAddresses removes the DHCP reservations of the instance NICs.
+func (i *Instance) releaseAddresses(l backend.Backend) error {
+	for _, intf := range i.Interfaces {
+		if intf.Network == "" || intf.MAC == "" {
+			continue
+		}
+		netw, err := network.Get(l, intf.Network)
+		if err != nil {
+			return err
+		}
+		if netw == nil {
+			continue
+		}
+		if err := netw.Release(l, intf.MAC); err != nil {
+			return err
+		}
+	}
+	return nil
+}
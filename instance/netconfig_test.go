@@ -0,0 +1,57 @@
+package instance
+
+import (
+	"net"
+	"testing"
+
+	"github.com/michaelhenkel/gokvm/network"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNetworkConfigMixed(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.100.0/24")
+	inst := &Instance{
+		Name: "c-instance-0.test.local",
+		Networks: []NetworkAttachment{{
+			Network: network.Network{Name: "static", Subnet: subnet, Gateway: net.ParseIP("192.168.100.1")},
+			IP:      net.ParseIP("192.168.100.10"),
+		}, {
+			Network: network.Network{Name: "dhcp"},
+		}, {
+			Network: network.Network{Name: "dhcp"},
+			MAC:     "52:54:00:00:00:01",
+		}},
+	}
+	inst.assignMACs()
+	out, err := inst.networkConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config networkConfig
+	if err := yaml.Unmarshal(out, &config); err != nil {
+		t.Fatal(err)
+	}
+	macs := map[string]bool{}
+	for name, ethernet := range config.Ethernets {
+		if ethernet.Match.MACAddress == "" {
+			t.Errorf("%s is matched by an empty MAC", name)
+		}
+		macs[ethernet.Match.MACAddress] = true
+	}
+	if len(macs) != 3 {
+		t.Errorf("got MACs %v, want 3 distinct", macs)
+	}
+	if mac := config.Ethernets["eth2"].Match.MACAddress; mac != "52:54:00:00:00:01" {
+		t.Errorf("eth2 is matched by %s, want the configured MAC", mac)
+	}
+	if eth0 := config.Ethernets["eth0"]; eth0.DHCP4 || len(eth0.Addresses) != 1 || eth0.Gateway4 != "192.168.100.1" {
+		t.Errorf("got eth0 %+v, want a static address with gateway", eth0)
+	}
+	if !config.Ethernets["eth1"].DHCP4 {
+		t.Error("eth1 does not use DHCP")
+	}
+	inst.assignMACs()
+	if out2, _ := inst.networkConfig(); string(out2) != string(out) {
+		t.Error("assigning MACs twice changed the network config")
+	}
+}
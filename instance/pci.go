@@ -0,0 +1,201 @@
+package instance
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+// On q35 every PCIe device sits alone on a pcie-root-port. The root ports
+// themselves are placed on the root bus, grouped as functions of
+// multifunction slots.
+const (
+	maxPCISlot     = 31
+	maxPCIFunction = 7
+	firstPCIESlot  = 1
+	rootPortBase   = 0x10
+)
+
+// pciAllocator assigns PCI addresses to the devices gokvm adds to a
+// domain. It hands out free pcie-root-ports and adds new ones to the
+// domain when all existing ports are taken.
+type pciAllocator struct {
+	domain *libvirtxml.Domain
+	// rootPorts holds the controller index of every pcie-root-port.
+	rootPorts []uint
+	// usedBuses holds buses that already carry a device.
+	usedBuses map[uint]bool
+	// rootSlots holds the used functions of every slot on bus 0.
+	rootSlots map[uint]map[uint]bool
+	// rootPortSlots holds the bus 0 slots that are multifunction
+	// groups of root ports and can take more of them.
+	rootPortSlots map[uint]bool
+	maxIndex      uint
+}
+
+func newPCIAllocator(domain *libvirtxml.Domain) (*pciAllocator, error) {
+	if domain.Devices == nil {
+		domain.Devices = &libvirtxml.DomainDeviceList{}
+	}
+	p := &pciAllocator{
+		domain:        domain,
+		usedBuses:     make(map[uint]bool),
+		rootSlots:     make(map[uint]map[uint]bool),
+		rootPortSlots: make(map[uint]bool),
+	}
+	for _, controller := range domain.Devices.Controllers {
+		if controller.Type != "pci" || controller.Index == nil {
+			continue
+		}
+		if *controller.Index > p.maxIndex {
+			p.maxIndex = *controller.Index
+		}
+		if controller.Model != "pcie-root-port" {
+			continue
+		}
+		p.rootPorts = append(p.rootPorts, *controller.Index)
+		if controller.Address != nil && controller.Address.PCI != nil {
+			addr := controller.Address.PCI
+			if addr.Bus != nil && *addr.Bus == 0 && addr.Slot != nil && addr.Function != nil && *addr.Function == 0 && addr.MultiFunction == "on" {
+				p.rootPortSlots[*addr.Slot] = true
+			}
+		}
+	}
+	sort.Slice(p.rootPorts, func(a, b int) bool { return p.rootPorts[a] < p.rootPorts[b] })
+
+	// Addresses are collected from the marshalled domain so that every
+	// device type is covered.
+	domainXML, err := domain.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	dec := xml.NewDecoder(strings.NewReader(domainXML))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "address" {
+			continue
+		}
+		attrs := make(map[string]string)
+		for _, attr := range start.Attr {
+			attrs[attr.Name.Local] = attr.Value
+		}
+		if attrs["type"] != "pci" {
+			continue
+		}
+		bus, err := strconv.ParseUint(attrs["bus"], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pci bus %q: %s", attrs["bus"], err)
+		}
+		if bus != 0 {
+			p.usedBuses[uint(bus)] = true
+			continue
+		}
+		slot, err := strconv.ParseUint(attrs["slot"], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pci slot %q: %s", attrs["slot"], err)
+		}
+		function, err := strconv.ParseUint(attrs["function"], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pci function %q: %s", attrs["function"], err)
+		}
+		if p.rootSlots[uint(slot)] == nil {
+			p.rootSlots[uint(slot)] = make(map[uint]bool)
+		}
+		p.rootSlots[uint(slot)][uint(function)] = true
+	}
+	return p, nil
+}
+
+// allocate returns the address of a free root port, adding a root port
+// if needed.
+func (p *pciAllocator) allocate() (*libvirtxml.DomainAddress, error) {
+	for _, port := range p.rootPorts {
+		if !p.usedBuses[port] {
+			p.usedBuses[port] = true
+			return pciAddress(port, 0, 0, ""), nil
+		}
+	}
+	port, err := p.addRootPort()
+	if err != nil {
+		return nil, err
+	}
+	p.usedBuses[port] = true
+	return pciAddress(port, 0, 0, ""), nil
+}
+
+func (p *pciAllocator) addRootPort() (uint, error) {
+	slot, function, err := p.freeRootSlot()
+	if err != nil {
+		return 0, err
+	}
+	index := p.maxIndex + 1
+	portNumber := rootPortBase + index - 1
+	multiFunction := ""
+	if function == 0 {
+		multiFunction = "on"
+		p.rootPortSlots[slot] = true
+	}
+	if p.rootSlots[slot] == nil {
+		p.rootSlots[slot] = make(map[uint]bool)
+	}
+	p.rootSlots[slot][function] = true
+	p.domain.Devices.Controllers = append(p.domain.Devices.Controllers, libvirtxml.DomainController{
+		Type:  "pci",
+		Index: getUintPtr(index),
+		Model: "pcie-root-port",
+		PCI: &libvirtxml.DomainControllerPCI{
+			Model: &libvirtxml.DomainControllerPCIModel{
+				Name: "pcie-root-port",
+			},
+			Target: &libvirtxml.DomainControllerPCITarget{
+				Chassis: getUintPtr(index),
+				Port:    getUintPtr(portNumber),
+			},
+		},
+		Address: pciAddress(0, slot, function, multiFunction),
+	})
+	p.maxIndex = index
+	p.rootPorts = append(p.rootPorts, index)
+	return index, nil
+}
+
+// freeRootSlot finds a bus 0 position for a new root port: a free
+// function in an existing root port group, or an empty slot.
+func (p *pciAllocator) freeRootSlot() (uint, uint, error) {
+	for slot := uint(firstPCIESlot); slot <= maxPCISlot; slot++ {
+		if !p.rootPortSlots[slot] {
+			continue
+		}
+		for function := uint(0); function <= maxPCIFunction; function++ {
+			if !p.rootSlots[slot][function] {
+				return slot, function, nil
+			}
+		}
+	}
+	for slot := uint(firstPCIESlot); slot <= maxPCISlot; slot++ {
+		if len(p.rootSlots[slot]) == 0 {
+			return slot, 0, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("no free pci slot left for a pcie-root-port")
+}
+
+func pciAddress(bus uint, slot uint, function uint, multiFunction string) *libvirtxml.DomainAddress {
+	return &libvirtxml.DomainAddress{
+		PCI: &libvirtxml.DomainAddressPCI{
+			Domain:        getUintPtr(0),
+			Bus:           getUintPtr(bus),
+			Slot:          getUintPtr(slot),
+			Function:      getUintPtr(function),
+			MultiFunction: multiFunction,
+		},
+	}
+}
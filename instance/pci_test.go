@@ -0,0 +1,165 @@
+package instance
+
+import (
+	"testing"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+func rootPort(index, slot, function uint, multiFunction string) libvirtxml.DomainController {
+	return libvirtxml.DomainController{
+		Type:    "pci",
+		Index:   getUintPtr(index),
+		Model:   "pcie-root-port",
+		Address: pciAddress(0, slot, function, multiFunction),
+	}
+}
+
+func pciDisk(bus, slot uint) libvirtxml.DomainDisk {
+	return libvirtxml.DomainDisk{
+		Device:  "disk",
+		Target:  &libvirtxml.DomainDiskTarget{Dev: "vd", Bus: "virtio"},
+		Address: pciAddress(bus, slot, 0, ""),
+	}
+}
+
+func TestPCIAllocator(t *testing.T) {
+	type position struct {
+		index, slot, function uint
+		multiFunction         string
+	}
+	tests := []struct {
+		name        string
+		controllers []libvirtxml.DomainController
+		disks       []libvirtxml.DomainDisk
+		allocations int
+		wantBuses   []uint
+		// wantPorts are the root ports added to the domain
+		wantPorts []position
+		wantErr   bool
+	}{{
+		name:        "no root ports",
+		controllers: []libvirtxml.DomainController{{Type: "pci", Index: getUintPtr(0), Model: "pcie-root"}},
+		allocations: 3,
+		wantBuses:   []uint{1, 2, 3},
+		wantPorts:   []position{{1, 1, 0, "on"}, {2, 1, 1, ""}, {3, 1, 2, ""}},
+	}, {
+		name:        "free existing port",
+		controllers: []libvirtxml.DomainController{rootPort(1, 2, 0, "on"), rootPort(2, 2, 1, "")},
+		disks:       []libvirtxml.DomainDisk{pciDisk(1, 0), pciDisk(0, 1)},
+		allocations: 2,
+		wantBuses:   []uint{2, 3},
+		wantPorts:   []position{{3, 2, 2, ""}},
+	}, {
+		name: "full root port group",
+		controllers: []libvirtxml.DomainController{
+			rootPort(1, 1, 0, "on"), rootPort(2, 1, 1, ""), rootPort(3, 1, 2, ""), rootPort(4, 1, 3, ""),
+			rootPort(5, 1, 4, ""), rootPort(6, 1, 5, ""), rootPort(7, 1, 6, ""), rootPort(8, 1, 7, ""),
+		},
+		allocations: 9,
+		wantBuses:   []uint{1, 2, 3, 4, 5, 6, 7, 8, 9},
+		wantPorts:   []position{{9, 2, 0, "on"}},
+	}, {
+		name:        "root port after other controllers",
+		controllers: []libvirtxml.DomainController{{Type: "pci", Index: getUintPtr(0), Model: "pcie-root"}, {Type: "pci", Index: getUintPtr(4), Model: "pcie-to-pci-bridge", Address: pciAddress(0, 1, 0, "")}},
+		allocations: 1,
+		wantBuses:   []uint{5},
+		wantPorts:   []position{{5, 2, 0, "on"}},
+	}, {
+		name:        "last slot",
+		disks:       slotsTaken(1, maxPCISlot-1),
+		allocations: 8,
+		wantBuses:   []uint{1, 2, 3, 4, 5, 6, 7, 8},
+		wantPorts: []position{
+			{1, maxPCISlot, 0, "on"}, {2, maxPCISlot, 1, ""}, {3, maxPCISlot, 2, ""}, {4, maxPCISlot, 3, ""},
+			{5, maxPCISlot, 4, ""}, {6, maxPCISlot, 5, ""}, {7, maxPCISlot, 6, ""}, {8, maxPCISlot, 7, ""},
+		},
+	}, {
+		name:        "last slot exhausted",
+		disks:       slotsTaken(1, maxPCISlot-1),
+		allocations: 9,
+		wantErr:     true,
+	}, {
+		name:        "slots exhausted",
+		disks:       slotsTaken(1, maxPCISlot),
+		allocations: 1,
+		wantErr:     true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain := &libvirtxml.Domain{
+				Devices: &libvirtxml.DomainDeviceList{
+					Controllers: tt.controllers,
+					Disks:       tt.disks,
+				},
+			}
+			existing := len(domain.Devices.Controllers)
+			p, err := newPCIAllocator(domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buses []uint
+			for n := 0; n < tt.allocations; n++ {
+				addr, err := p.allocate()
+				if err != nil {
+					// only the last allocation may fail
+					if !tt.wantErr || n != tt.allocations-1 {
+						t.Fatalf("allocation %d: %s", n+1, err)
+					}
+					return
+				}
+				if addr.PCI == nil || *addr.PCI.Slot != 0 || *addr.PCI.Function != 0 {
+					t.Fatalf("got address %+v, want slot 0 of a root port", addr.PCI)
+				}
+				buses = append(buses, *addr.PCI.Bus)
+			}
+			if tt.wantErr {
+				t.Fatal("allocating succeeded, want an error")
+			}
+			if !equalUints(buses, tt.wantBuses) {
+				t.Errorf("got buses %v, want %v", buses, tt.wantBuses)
+			}
+			var ports []position
+			for _, controller := range domain.Devices.Controllers[existing:] {
+				addr := controller.Address.PCI
+				ports = append(ports, position{*controller.Index, *addr.Slot, *addr.Function, addr.MultiFunction})
+				if controller.Model != "pcie-root-port" || *addr.Bus != 0 {
+					t.Errorf("added controller %s on bus %d, want a root port on bus 0", controller.Model, *addr.Bus)
+				}
+			}
+			if len(ports) != len(tt.wantPorts) {
+				t.Fatalf("got root ports %v, want %v", ports, tt.wantPorts)
+			}
+			for idx := range ports {
+				if ports[idx] != tt.wantPorts[idx] {
+					t.Errorf("got root ports %v, want %v", ports, tt.wantPorts)
+					break
+				}
+			}
+			if _, err := domain.Marshal(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// slotsTaken returns disks occupying the bus 0 slots first to last.
+func slotsTaken(first, last uint) []libvirtxml.DomainDisk {
+	var disks []libvirtxml.DomainDisk
+	for slot := first; slot <= last; slot++ {
+		disks = append(disks, pciDisk(0, slot))
+	}
+	return disks
+}
+
+func equalUints(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package instance
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// jinjaHeader marks user-data cloud-init renders itself, it is passed on
+// untouched.
+const jinjaHeader = "## template: jinja"
+
+// Peer is another member of the cluster of an instance.
+type Peer struct {
+	Name  string
+	Role  Role
+	Index int
+	// Address is the static address on the management network, nil
+	// without static addressing.
+	Address net.IP
+}
+
+// Hostname returns the name up to the first dot.
+func (p Peer) Hostname() string {
+	return strings.SplitN(p.Name, ".", 2)[0]
+}
+
+// templateData is what user-data templates see, e.g.
+//
+//	{{ range .Controllers }}{{ .Address }} {{ .Name }}{{ end }}
+type templateData struct {
+	Peer
+	ClusterName string
+	Suffix      string
+	Peers       []Peer
+}
+
+// Controllers returns the controller peers.
+func (d templateData) Controllers() []Peer {
+	return d.peersWithRole(Controller)
+}
+
+// Workers returns the worker peers.
+func (d templateData) Workers() []Peer {
+	return d.peersWithRole(Worker)
+}
+
+func (d templateData) peersWithRole(role Role) []Peer {
+	var peers []Peer
+	for _, peer := range d.Peers {
+		if peer.Role == role {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// self returns the instance as a peer of the others.
+func (i *Instance) self() Peer {
+	peer := Peer{
+		Name:  i.Name,
+		Role:  i.Role,
+		Index: i.Index,
+	}
+	if len(i.Networks) > 0 {
+		peer.Address = i.Networks[0].IP
+	}
+	return peer
+}
+
+// readUserData reads the user-data file and renders it as a template with
+// templateData.
+func (i *Instance) readUserData(file string) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(content, []byte(jinjaHeader)) {
+		return content, nil
+	}
+	tmpl, err := template.New(file).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("user-data %s: %s", file, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, templateData{
+		Peer:        i.self(),
+		ClusterName: i.ClusterName,
+		Suffix:      i.Suffix,
+		Peers:       i.Peers,
+	}); err != nil {
+		return nil, fmt.Errorf("user-data %s: %s", file, err)
+	}
+	return out.Bytes(), nil
+}
+
+// etcHosts renders /etc/hosts with the instance and its peers, it is
+// empty if the addresses are unknown.
+func (i *Instance) etcHosts() string {
+	self := i.self()
+	if self.Address == nil {
+		return ""
+	}
+	var hosts strings.Builder
+	hosts.WriteString("127.0.0.1 localhost\n")
+	hosts.WriteString("::1 localhost ip6-localhost ip6-loopback\n")
+	for _, peer := range append([]Peer{self}, i.Peers...) {
+		if peer.Address == nil {
+			continue
+		}
+		fmt.Fprintf(&hosts, "%s %s %s\n", peer.Address, peer.Name, peer.Hostname())
+	}
+	return hosts.String()
+}
@@ -0,0 +1,117 @@
+package instance
+
+import (
+	"net"
+	"testing"
+)
+
+func newPeerInstance(address net.IP) *Instance {
+	inst := &Instance{
+		Name:        "c-instance-0.test.local",
+		ClusterName: "test",
+		Suffix:      "test.local",
+		Role:        Controller,
+		Peers: []Peer{
+			{Name: "c-instance-1.test.local", Role: Controller, Index: 1, Address: net.ParseIP("192.168.100.11")},
+			{Name: "w-instance-0.test.local", Role: Worker, Address: net.ParseIP("192.168.100.20")},
+		},
+	}
+	if address != nil {
+		inst.Networks = []NetworkAttachment{{IP: address}}
+	}
+	return inst
+}
+
+func TestEtcHosts(t *testing.T) {
+	tests := []struct {
+		name string
+		inst *Instance
+		want string
+	}{
+		{
+			name: "static",
+			inst: newPeerInstance(net.ParseIP("192.168.100.10")),
+			want: "127.0.0.1 localhost\n" +
+				"::1 localhost ip6-localhost ip6-loopback\n" +
+				"192.168.100.10 c-instance-0.test.local c-instance-0\n" +
+				"192.168.100.11 c-instance-1.test.local c-instance-1\n" +
+				"192.168.100.20 w-instance-0.test.local w-instance-0\n",
+		},
+		{
+			name: "dhcp",
+			inst: newPeerInstance(nil),
+			want: "",
+		},
+		{
+			name: "peer without address",
+			inst: &Instance{
+				Name:     "vm",
+				Networks: []NetworkAttachment{{IP: net.ParseIP("192.168.100.10")}},
+				Peers:    []Peer{{Name: "other"}},
+			},
+			want: "127.0.0.1 localhost\n" +
+				"::1 localhost ip6-localhost ip6-loopback\n" +
+				"192.168.100.10 vm vm\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.inst.etcHosts(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadUserData(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "plain",
+			content: "#cloud-config\npackages: [jq]\n",
+			want:    "#cloud-config\npackages: [jq]\n",
+		},
+		{
+			name:    "self",
+			content: "{{ .Name }} {{ .Hostname }} {{ .Role }} {{ .Index }} {{ .Address }} {{ .ClusterName }} {{ .Suffix }}",
+			want:    "c-instance-0.test.local c-instance-0 controller 0 192.168.100.10 test test.local",
+		},
+		{
+			name:    "peers",
+			content: "{{ range .Controllers }}{{ .Address }} {{ .Name }};{{ end }}{{ range .Workers }}{{ .Hostname }};{{ end }}",
+			want:    "192.168.100.11 c-instance-1.test.local;w-instance-0;",
+		},
+		{
+			name:    "jinja",
+			content: "## template: jinja\n#cloud-config\nhostname: {{ v1.local_hostname }}\n",
+			want:    "## template: jinja\n#cloud-config\nhostname: {{ v1.local_hostname }}\n",
+		},
+		{
+			name:    "unknown field",
+			content: "{{ .Missing }}",
+			wantErr: true,
+		},
+		{
+			name:    "syntax error",
+			content: "{{ .Name ",
+			wantErr: true,
+		},
+	}
+	inst := newPeerInstance(net.ParseIP("192.168.100.10"))
+	for _, tt := range tests {
+		file := writeUserData(t, map[string]string{"user-data": tt.content})[0]
+		got, err := inst.readUserData(file)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want an error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if _, err := inst.readUserData("/missing/user-data"); err == nil {
+		t.Error("reading a missing file succeeded")
+	}
+}
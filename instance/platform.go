@@ -0,0 +1,216 @@
+package instance
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/michaelhenkel/gokvm/backend"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+const (
+	CPUModeHostModel       = "host-model"
+	CPUModeHostPassthrough = "host-passthrough"
+	CPUModeCustom          = "custom"
+)
+
+// Platform describes the virtual hardware of an instance. Empty fields
+// are filled in by DetectPlatform from the host capabilities.
+type Platform struct {
+	Arch       string
+	DomainType string
+	Emulator   string
+	Machine    string
+	CPUMode    string
+	CPUModel   string
+}
+
+// DetectPlatform completes p from the libvirt host and domain
+// capabilities. Fields already set in p are kept as they are, a CPU model
+// without CPU mode means custom.
+func DetectPlatform(l backend.Backend, p Platform) (Platform, error) {
+	capsXML, err := l.Capabilities()
+	if err != nil {
+		return p, err
+	}
+	var caps libvirtxml.Caps
+	if err := caps.Unmarshal(capsXML); err != nil {
+		return p, err
+	}
+	if p.Arch == "" {
+		p.Arch = hostArch(&caps)
+	}
+	var guest *libvirtxml.CapsGuest
+	for idx := range caps.Guests {
+		if caps.Guests[idx].OSType == "hvm" && caps.Guests[idx].Arch.Name == p.Arch {
+			guest = &caps.Guests[idx]
+			break
+		}
+	}
+	if guest == nil {
+		return p, fmt.Errorf("host does not support hvm guests for %s", p.Arch)
+	}
+
+	machines := guest.Arch.Machines
+	emulator := guest.Arch.Emulator
+	if p.DomainType == "" {
+		p.DomainType = "qemu"
+		for _, domain := range guest.Arch.Domains {
+			if domain.Type == "kvm" {
+				p.DomainType = "kvm"
+				break
+			}
+		}
+	}
+	for _, domain := range guest.Arch.Domains {
+		if domain.Type != p.DomainType {
+			continue
+		}
+		if domain.Emulator != "" {
+			emulator = domain.Emulator
+		}
+		if len(domain.Machines) > 0 {
+			machines = domain.Machines
+		}
+	}
+	if p.Emulator == "" {
+		p.Emulator = emulator
+	}
+	if p.Machine == "" {
+		p.Machine = newestQ35(machines)
+	}
+
+	if p.CPUMode == "" && p.CPUModel != "" {
+		p.CPUMode = CPUModeCustom
+	}
+	if p.CPUMode == "" {
+		p.CPUMode, err = detectCPUMode(l, p)
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func hostArch(caps *libvirtxml.Caps) string {
+	if caps.Host.CPU != nil && caps.Host.CPU.Arch != "" {
+		return caps.Host.CPU.Arch
+	}
+	switch runtime.GOARCH {
+	case "arm64":
+		return "aarch64"
+	case "ppc64le":
+		return "ppc64le"
+	case "s390x":
+		return "s390x"
+	}
+	return "x86_64"
+}
+
+// newestQ35 returns the machine type the q35 alias points to or, without
+// an alias, the pc-q35-* machine with the highest version.
+func newestQ35(machines []libvirtxml.CapsGuestMachine) string {
+	var versioned []string
+	for _, machine := range machines {
+		if machine.Name == "q35" && machine.Canonical != "" {
+			return machine.Canonical
+		}
+		if strings.HasPrefix(machine.Name, "pc-q35-") {
+			versioned = append(versioned, machine.Name)
+		}
+	}
+	if len(versioned) == 0 {
+		return "q35"
+	}
+	sort.Slice(versioned, func(a, b int) bool {
+		return versionLess(versioned[a], versioned[b])
+	})
+	return versioned[len(versioned)-1]
+}
+
+// machineVersion splits the version of a machine type like pc-q35-6.2 or
+// pc-q35-rhel8.2.0 into its vendor prefix and numbers. Parts that are no
+// number end the version.
+func machineVersion(machine string) (string, []int) {
+	version := machine[strings.LastIndex(machine, "-")+1:]
+	digits := strings.IndexFunc(version, unicode.IsDigit)
+	if digits < 0 {
+		return version, nil
+	}
+	var numbers []int
+	for _, part := range strings.Split(version[digits:], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+	}
+	return version[:digits], numbers
+}
+
+// versionLess orders machine types by vendor prefix and then by version,
+// so pc-q35-2.10 comes after pc-q35-2.9.
+func versionLess(a, b string) bool {
+	vendorA, va := machineVersion(a)
+	vendorB, vb := machineVersion(b)
+	if vendorA != vendorB {
+		return vendorA < vendorB
+	}
+	for idx := 0; idx < len(va) && idx < len(vb); idx++ {
+		if va[idx] != vb[idx] {
+			return va[idx] < vb[idx]
+		}
+	}
+	return len(va) < len(vb)
+}
+
+func detectCPUMode(l backend.Backend, p Platform) (string, error) {
+	domCapsXML, err := l.DomainCapabilities(p.Emulator, p.Arch, p.Machine, p.DomainType)
+	if err != nil {
+		return "", err
+	}
+	var domCaps libvirtxml.DomainCaps
+	if err := domCaps.Unmarshal(domCapsXML); err != nil {
+		return "", err
+	}
+	supported := map[string]bool{}
+	if domCaps.CPU != nil {
+		for _, mode := range domCaps.CPU.Modes {
+			supported[mode.Name] = mode.Supported == "yes"
+		}
+	}
+	for _, mode := range []string{CPUModeHostModel, CPUModeHostPassthrough} {
+		if supported[mode] {
+			return mode, nil
+		}
+	}
+	return "", nil
+}
+
+func (p Platform) domainCPU() *libvirtxml.DomainCPU {
+	switch p.CPUMode {
+	case "":
+		return nil
+	case CPUModeCustom:
+		cpu := &libvirtxml.DomainCPU{
+			Mode:  CPUModeCustom,
+			Match: "exact",
+			Check: "partial",
+		}
+		if p.CPUModel != "" {
+			cpu.Model = &libvirtxml.DomainCPUModel{
+				Value:    p.CPUModel,
+				Fallback: "allow",
+			}
+		}
+		return cpu
+	}
+	return &libvirtxml.DomainCPU{
+		Mode: p.CPUMode,
+	}
+}
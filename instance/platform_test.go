@@ -0,0 +1,77 @@
+package instance
+
+import (
+	"testing"
+
+	"github.com/michaelhenkel/gokvm/backend/fake"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"pc-q35-2.9", "pc-q35-2.10", true},
+		{"pc-q35-2.10", "pc-q35-2.9", false},
+		{"pc-q35-6.2", "pc-q35-6.2", false},
+		{"pc-q35-6.2", "pc-q35-7.0", true},
+		{"pc-q35-6", "pc-q35-6.0", true},
+		{"pc-q35-rhel8.2.0", "pc-q35-rhel8.10.0", true},
+		{"pc-q35-rhel7.6.0", "pc-q35-rhel8.0.0", true},
+		{"pc-q35-rhel9.0.0", "pc-q35-rhel8.6.0", false},
+		{"pc-q35-8.2", "pc-q35-rhel7.6.0", true},
+	}
+	for _, tt := range tests {
+		if got := versionLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("versionLess(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNewestQ35(t *testing.T) {
+	machines := func(names ...string) []libvirtxml.CapsGuestMachine {
+		var list []libvirtxml.CapsGuestMachine
+		for _, name := range names {
+			list = append(list, libvirtxml.CapsGuestMachine{Name: name})
+		}
+		return list
+	}
+	tests := []struct {
+		name     string
+		machines []libvirtxml.CapsGuestMachine
+		want     string
+	}{
+		{"alias", []libvirtxml.CapsGuestMachine{{Name: "pc-q35-6.2"}, {Name: "q35", Canonical: "pc-q35-6.1"}}, "pc-q35-6.1"},
+		{"two digit minor", machines("pc-q35-2.9", "pc-q35-2.10", "pc-q35-2.11", "pc-i440fx-9.0"), "pc-q35-2.11"},
+		{"rhel", machines("pc-q35-rhel8.2.0", "pc-q35-rhel8.10.0", "pc-q35-rhel7.6.0"), "pc-q35-rhel8.10.0"},
+		{"none", machines("pc-i440fx-6.2"), "q35"},
+	}
+	for _, tt := range tests {
+		if got := newestQ35(tt.machines); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectPlatformCPUModel(t *testing.T) {
+	p, err := DetectPlatform(fake.New(), Platform{CPUModel: "Skylake-Server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CPUMode != CPUModeCustom {
+		t.Errorf("got CPU mode %q, want custom", p.CPUMode)
+	}
+	cpu := p.domainCPU()
+	if cpu == nil || cpu.Model == nil || cpu.Model.Value != "Skylake-Server" {
+		t.Errorf("got domain CPU %+v, want model Skylake-Server", cpu)
+	}
+
+	if p, err = DetectPlatform(fake.New(), Platform{}); err != nil {
+		t.Fatal(err)
+	}
+	if p.CPUMode != CPUModeHostModel {
+		t.Errorf("got CPU mode %q without model, want host-model", p.CPUMode)
+	}
+}
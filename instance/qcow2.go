@@ -1,17 +1,18 @@
 package instance
 
 import (
-	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
-
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/michaelhenkel/gokvm/backend"
 	"github.com/michaelhenkel/gokvm/image"
-	//qcow2 "github.com/zchee/go-qcow2"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
 )
 
-func (i *Instance) createInstanceImage() (*image.Image, error) {
-	existingImg, err := image.Get(i.Name, i.Image.Pool)
+// createInstanceImage creates the instance root disk as a qcow2 overlay
+// backed by the base image. The volume is created by the backend, so it
+// works for remote connections as well.
+func (i *Instance) createInstanceImage(l backend.Backend) (*image.Image, error) {
+	existingImg, err := image.Get(l, i.Name, i.Image.Pool)
 	if err != nil {
 		return nil, err
 	}
@@ -19,47 +20,39 @@ func (i *Instance) createInstanceImage() (*image.Image, error) {
 		return existingImg, nil
 	}
 
-	out, err := ioutil.TempDir("/tmp", "prefix")
+	diskSize, err := bytefmt.ToBytes(i.Resources.Disk)
 	if err != nil {
 		return nil, err
 	}
-	defer os.RemoveAll(out)
-	/*
-		log.Info("disk size", int64(i.Resources.Disk))
-
-		opts := &qcow2.Opts{
-			Filename:      fmt.Sprintf("%s/%s", out, i.Name),
-			BackingFile:   i.Image.Path,
-			BackingFormat: "qcow2",
-			Fmt:           "qcow2",
-			Size:          int64(i.Resources.Disk),
-			ClusterSize:   512,
-		}
-		_, err = qcow2.Create(opts)
-		if err != nil {
-			return nil, err
-		}
-	*/
-	cmd := exec.Command("qemu-img", "create", "-b", i.Image.Path, "-f", "qcow2", "-F", "qcow2", fmt.Sprintf("%s/%s", out, i.Name), i.Resources.Disk)
-	_, err = cmd.Output()
+	pool, err := l.LookupStoragePool(i.Image.Pool)
 	if err != nil {
 		return nil, err
 	}
-	//log.Info(string(stdout))
-	//qemu-img create -b ${imageName} -f qcow2 -F qcow2 ${libvirtImageLocation}/${imageName}-${clusterName}-${hostname}.qcow2 ${disk}
-	img := &image.Image{
-		Pool:              i.Image.Pool,
-		Name:              i.Name,
-		ImageLocationType: image.File,
-		ImageLocation:     fmt.Sprintf("%s/%s", out, i.Name),
+	vol := libvirtxml.StorageVolume{
+		Name: i.Name,
+		Type: "file",
+		Capacity: &libvirtxml.StorageVolumeSize{
+			Unit:  "bytes",
+			Value: diskSize,
+		},
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format: &libvirtxml.StorageVolumeTargetFormat{
+				Type: "qcow2",
+			},
+		},
+		BackingStore: &libvirtxml.StorageVolumeBackingStore{
+			Path: i.Image.Path,
+			Format: &libvirtxml.StorageVolumeTargetFormat{
+				Type: i.Image.BackingFormat(),
+			},
+		},
 	}
-	if err := img.Create(); err != nil {
+	volXML, err := vol.Marshal()
+	if err != nil {
 		return nil, err
 	}
-	img, err = image.Get(img.Name, img.Pool)
-	if err != nil {
+	if _, err := pool.CreateVolume(volXML); err != nil {
 		return nil, err
 	}
-
-	return img, nil
+	return image.Get(l, i.Name, i.Image.Pool)
 }
@@ -0,0 +1,162 @@
+package instance
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/metadata"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+type Snapshot struct {
+	Name     string
+	Instance string
+	// ClusterName is set when the snapshot was taken as part of a
+	// cluster snapshot.
+	ClusterName  string
+	State        string
+	CreationTime time.Time
+}
+
+// CreateSnapshot takes an internal snapshot of the instance disks. With
+// clusterWide set, the snapshot is recorded as part of the cluster
+// snapshot of the same name. The snapshot remembers i.State, so an
+// instance paused only for the snapshot runs again after a revert.
+func (i *Instance) CreateSnapshot(l backend.Backend, name string, clusterWide bool) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	domainXML, err := domain.XML()
+	if err != nil {
+		return err
+	}
+	var xmlDomain libvirtxml.Domain
+	if err := xmlDomain.Unmarshal(domainXML); err != nil {
+		return err
+	}
+	state := string(i.State)
+	m := &metadata.Metadata{State: &state}
+	if clusterWide {
+		m.Cluster = &i.ClusterName
+	}
+	snap := libvirtxml.DomainSnapshot{
+		Name:        name,
+		Description: m.InstanceMetadata(),
+		Disks:       &libvirtxml.DomainSnapshotDisks{},
+	}
+	if xmlDomain.Devices != nil {
+		for _, disk := range xmlDomain.Devices.Disks {
+			if disk.Target == nil {
+				continue
+			}
+			snapshotType := "internal"
+			if disk.Device == "cdrom" {
+				snapshotType = "no"
+			}
+			snap.Disks.Disks = append(snap.Disks.Disks, libvirtxml.DomainSnapshotDisk{
+				Name:     disk.Target.Dev,
+				Snapshot: snapshotType,
+			})
+		}
+	}
+	snapXML, err := snap.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = domain.CreateSnapshot(snapXML)
+	return err
+}
+
+func (i *Instance) ListSnapshots(l backend.Backend) ([]*Snapshot, error) {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := domain.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	for _, snap := range snaps {
+		snapXML, err := snap.XML()
+		if err != nil {
+			return nil, err
+		}
+		var xmlSnapshot libvirtxml.DomainSnapshot
+		if err := xmlSnapshot.Unmarshal(snapXML); err != nil {
+			return nil, err
+		}
+		s := &Snapshot{
+			Name:     xmlSnapshot.Name,
+			Instance: i.Name,
+			State:    xmlSnapshot.State,
+		}
+		if created, err := strconv.ParseInt(xmlSnapshot.CreationTime, 10, 64); err == nil {
+			s.CreationTime = time.Unix(created, 0)
+		}
+		md, err := metadata.GetMetadata(xmlSnapshot.Description)
+		if err == nil && md.Cluster != nil {
+			s.ClusterName = *md.Cluster
+		}
+		if err == nil && md.State != nil {
+			s.State = *md.State
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
+}
+
+func (i *Instance) RevertSnapshot(l backend.Backend, name string) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	snap, err := domain.LookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	snapXML, err := snap.XML()
+	if err != nil {
+		return err
+	}
+	var xmlSnapshot libvirtxml.DomainSnapshot
+	if err := xmlSnapshot.Unmarshal(snapXML); err != nil {
+		return err
+	}
+	md, err := metadata.GetMetadata(xmlSnapshot.Description)
+	if err != nil {
+		return err
+	}
+	running := md.State != nil && *md.State == string(backend.DomainRunning)
+	return snap.Revert(running)
+}
+
+func (i *Instance) DeleteSnapshot(l backend.Backend, name string) error {
+	domain, err := l.LookupDomain(i.Name)
+	if err != nil {
+		return err
+	}
+	snap, err := domain.LookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	return snap.Delete()
+}
+
+func RenderSnapshots(snapshots []*Snapshot) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Instance", "Snapshot", "State", "Created", "Cluster"})
+	var tableRows []table.Row
+	for _, snap := range snapshots {
+		tableRows = append(tableRows, table.Row{snap.Instance, snap.Name, snap.State, snap.CreationTime.Format(time.RFC3339), snap.ClusterName})
+	}
+	t.AppendRows(tableRows)
+	t.SetStyle(table.StyleLight)
+	t.Render()
+}
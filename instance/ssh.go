@@ -0,0 +1,93 @@
+package instance
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// DefaultUser is the login of instances created before the user was
+// taken from the distro profile.
+const DefaultUser = "gokvm"
+
+// sshOptions skip host key checks, instances get new host keys whenever
+// a cluster is recreated.
+var sshOptions = [][2]string{
+	{"StrictHostKeyChecking", "no"},
+	{"UserKnownHostsFile", "/dev/null"},
+	{"LogLevel", "ERROR"},
+}
+
+func (i *Instance) user() string {
+	if i.User == "" {
+		return DefaultUser
+	}
+	return i.User
+}
+
+// Address returns the first IPv4 address reported for the instance,
+// preferring the management interface.
+func (i *Instance) Address() (string, error) {
+	var fallback string
+	for _, intf := range i.Interfaces {
+		for _, addr := range intf.IPAddresses {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			if ip.To4() != nil {
+				return addr, nil
+			}
+			if fallback == "" && !ip.IsLinkLocalUnicast() {
+				fallback = addr
+			}
+		}
+	}
+	if fallback != "" {
+		return fallback, nil
+	}
+	return "", fmt.Errorf("instance %s has no address", i.Name)
+}
+
+// SSHArgs returns the ssh command line running command on the instance,
+// an interactive login if command is empty.
+func (i *Instance) SSHArgs(command []string) ([]string, error) {
+	addr, err := i.Address()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"ssh"}
+	if i.SSHKey != "" {
+		args = append(args, "-i", i.SSHKey)
+	}
+	for _, option := range sshOptions {
+		args = append(args, "-o", option[0]+"="+option[1])
+	}
+	args = append(args, fmt.Sprintf("%s@%s", i.user(), addr))
+	return append(args, command...), nil
+}
+
+// WriteSSHConfig writes an ssh_config Host block per instance with an
+// address, instances without one are skipped.
+func WriteSSHConfig(w io.Writer, instances []*Instance) error {
+	for _, inst := range instances {
+		addr, err := inst.Address()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "Host %s\n", inst.Name)
+		fmt.Fprintf(w, "  HostName %s\n", addr)
+		fmt.Fprintf(w, "  User %s\n", inst.user())
+		if inst.SSHKey != "" {
+			fmt.Fprintf(w, "  IdentityFile %s\n", inst.SSHKey)
+			fmt.Fprintf(w, "  IdentitiesOnly yes\n")
+		}
+		for _, option := range sshOptions {
+			fmt.Fprintf(w, "  %s %s\n", option[0], option[1])
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package instance
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"text/template"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+type Role string
+
+const (
+	Controller Role = "controller"
+	Worker     Role = "worker"
+)
+
+// domainSkeleton returns the domain the generated devices are added to.
+// Without a DomainTemplate this is the embedded domainModel, otherwise
+// the template file is rendered with the instance as data. gokvm always
+// sets name, metadata, memory, vcpus, os type, cpu, emulator, disks and
+// interfaces, everything else (features, clock, controllers, graphics,
+// serial, channels, ...) is taken from the skeleton.
+func (i *Instance) domainSkeleton() (*libvirtxml.Domain, error) {
+	if i.DomainTemplate == "" {
+		return defaultDomain()
+	}
+	tmpl, err := template.New(filepath.Base(i.DomainTemplate)).Option("missingkey=error").ParseFiles(i.DomainTemplate)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, i); err != nil {
+		return nil, err
+	}
+	libvirtDomain := &libvirtxml.Domain{}
+	if err := libvirtDomain.Unmarshal(buf.String()); err != nil {
+		return nil, fmt.Errorf("domain template %s: %s", i.DomainTemplate, err)
+	}
+	if libvirtDomain.Devices == nil {
+		libvirtDomain.Devices = &libvirtxml.DomainDeviceList{}
+	}
+	return libvirtDomain, nil
+}
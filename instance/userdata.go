@@ -0,0 +1,176 @@
+package instance
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const cloudConfigHeader = "#cloud-config"
+
+// partTypes maps the first line of a user-data file to its MIME type.
+var partTypes = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#!", "text/x-shellscript"},
+	{"#include", "text/x-include-url"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#part-handler", "text/part-handler"},
+	{"#upstart-job", "text/upstart-job"},
+}
+
+// mergeUserData adds the user-data files of the instance to the generated
+// cloud-config. Cloud-config files are deep-merged into it: mappings are
+// merged key by key, lists are appended and other values replaced. Any
+// other user-data (scripts, boothooks, includes) is passed alongside the
+// cloud-config in a MIME multipart archive.
+func (i *Instance) mergeUserData(generated []byte) ([]byte, error) {
+	var config yaml.Node
+	if err := yaml.Unmarshal(generated, &config); err != nil {
+		return nil, err
+	}
+	type part struct {
+		name        string
+		contentType string
+		content     []byte
+	}
+	var parts []part
+	for _, file := range i.UserData {
+		content, err := i.readUserData(file)
+		if err != nil {
+			return nil, err
+		}
+		if contentType := userDataType(content); contentType != "" {
+			parts = append(parts, part{filepath.Base(file), contentType, content})
+			continue
+		}
+		var userConfig yaml.Node
+		if err := yaml.Unmarshal(content, &userConfig); err != nil {
+			return nil, fmt.Errorf("user-data %s: %s", file, err)
+		}
+		if err := mergeNode(&config, &userConfig); err != nil {
+			return nil, fmt.Errorf("user-data %s: %s", file, err)
+		}
+	}
+
+	merged, err := yaml.Marshal(&config)
+	if err != nil {
+		return nil, err
+	}
+	merged = append([]byte(cloudConfigHeader+"\n"), merged...)
+	if len(parts) == 0 {
+		return merged, nil
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts = append([]part{{"gokvm.cfg", "text/cloud-config", merged}}, parts...)
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", p.contentType+`; charset="utf-8"`)
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, p.name))
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(p.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", writer.Boundary())
+	return append([]byte(header), body.Bytes()...), nil
+}
+
+// userDataType returns the MIME type of user-data that is not a
+// cloud-config, an empty string for cloud-config.
+func userDataType(content []byte) string {
+	firstLine := strings.SplitN(string(content), "\n", 2)[0]
+	for _, partType := range partTypes {
+		if strings.HasPrefix(firstLine, partType.prefix) {
+			return partType.contentType
+		}
+	}
+	return ""
+}
+
+// mergeNode merges src into dst. An empty document, which yaml leaves as
+// a zero node, merges as nothing.
+func mergeNode(dst, src *yaml.Node) error {
+	if src.Kind == 0 {
+		return nil
+	}
+	if dst.Kind == 0 {
+		*dst = *src
+		return nil
+	}
+	if src.Kind == yaml.DocumentNode {
+		if len(src.Content) == 0 {
+			return nil
+		}
+		src = src.Content[0]
+	}
+	if dst.Kind == yaml.DocumentNode {
+		if len(dst.Content) == 0 {
+			dst.Content = []*yaml.Node{src}
+			return nil
+		}
+		dst = dst.Content[0]
+	}
+	if src.Kind == yaml.ScalarNode && src.Tag == "!!null" {
+		return nil
+	}
+	if dst.Kind != src.Kind {
+		if dst.Kind == yaml.MappingNode || dst.Kind == yaml.SequenceNode {
+			return fmt.Errorf("line %d: cannot merge %s into %s", src.Line, kindName(src.Kind), kindName(dst.Kind))
+		}
+		*dst = *src
+		return nil
+	}
+	switch src.Kind {
+	case yaml.MappingNode:
+		for idx := 0; idx+1 < len(src.Content); idx += 2 {
+			key, value := src.Content[idx], src.Content[idx+1]
+			if existing := mappingValue(dst, key.Value); existing != nil {
+				if err := mergeNode(existing, value); err != nil {
+					return err
+				}
+				continue
+			}
+			dst.Content = append(dst.Content, key, value)
+		}
+	case yaml.SequenceNode:
+		dst.Content = append(dst.Content, src.Content...)
+	default:
+		*dst = *src
+	}
+	return nil
+}
+
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for idx := 0; idx+1 < len(mapping.Content); idx += 2 {
+		if mapping.Content[idx].Value == key {
+			return mapping.Content[idx+1]
+		}
+	}
+	return nil
+}
+
+func kindName(kind yaml.Kind) string {
+	switch kind {
+	case yaml.MappingNode:
+		return "mapping"
+	case yaml.SequenceNode:
+		return "list"
+	}
+	return "value"
+}
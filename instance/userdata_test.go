@@ -0,0 +1,210 @@
+package instance
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		dst     string
+		src     string
+		want    string
+		wantErr bool
+	}{
+		{"add keys", "a: 1\n", "b: 2\n", "a: 1\nb: 2\n", false},
+		{"replace value", "a: 1\nb: 2\n", "a: 3\n", "a: 3\nb: 2\n", false},
+		{"deep merge", "a:\n  b: 1\n  c:\n    d: 2\n", "a:\n  c:\n    e: 3\n", "a:\n  b: 1\n  c:\n    d: 2\n    e: 3\n", false},
+		{"append list", "packages: [curl]\n", "packages: [jq, vim]\n", "packages: [curl, jq, vim]\n", false},
+		{"append nested list", "users:\n  - name: admin\n", "users:\n  - name: other\n", "users:\n  - name: admin\n  - name: other\n", false},
+		{"null keeps value", "a: 1\n", "a:\n", "a: 1\n", false},
+		{"empty source", "a: 1\n", "", "a: 1\n", false},
+		{"empty destination", "", "a: 1\n", "a: 1\n", false},
+		{"value replaced by mapping", "a: 1\n", "a:\n  b: 2\n", "a:\n  b: 2\n", false},
+		{"mapping into list", "a: [1]\n", "a:\n  b: 2\n", "", true},
+		{"list into mapping", "a:\n  b: 1\n", "a: [2]\n", "", true},
+		{"value into mapping", "a:\n  b: 1\n", "a: 2\n", "", true},
+	}
+	for _, tt := range tests {
+		var dst, src yaml.Node
+		if err := yaml.Unmarshal([]byte(tt.dst), &dst); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if err := yaml.Unmarshal([]byte(tt.src), &src); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		err := mergeNode(&dst, &src)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want an error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		merged, err := yaml.Marshal(&dst)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		var got, want interface{}
+		if err := yaml.Unmarshal(merged, &got); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if err := yaml.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %s, want %s", tt.name, merged, tt.want)
+		}
+	}
+}
+
+// writeUserData writes the user-data files to a temporary directory and
+// returns their paths.
+func writeUserData(t *testing.T, files map[string]string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestMergeUserData(t *testing.T) {
+	generated := []byte("#cloud-config\nhostname: vm\npackages: [curl]\n")
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "none",
+			want: map[string]interface{}{"hostname": "vm", "packages": []interface{}{"curl"}},
+		},
+		{
+			name:  "cloud-config",
+			files: map[string]string{"extra.cfg": "#cloud-config\npackages: [jq]\nruncmd: [reboot]\n"},
+			want: map[string]interface{}{
+				"hostname": "vm",
+				"packages": []interface{}{"curl", "jq"},
+				"runcmd":   []interface{}{"reboot"},
+			},
+		},
+		{
+			name:  "header only",
+			files: map[string]string{"empty.cfg": "#cloud-config\n"},
+			want:  map[string]interface{}{"hostname": "vm", "packages": []interface{}{"curl"}},
+		},
+		{
+			name:    "type conflict",
+			files:   map[string]string{"extra.cfg": "packages:\n  jq: latest\n"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid yaml",
+			files:   map[string]string{"extra.cfg": "packages: [\n"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		inst := &Instance{Name: "vm", UserData: writeUserData(t, tt.files)}
+		out, err := inst.mergeUserData(generated)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want an error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !bytes.HasPrefix(out, []byte(cloudConfigHeader+"\n")) {
+			t.Errorf("%s: got %q, want a cloud-config", tt.name, out)
+		}
+		var got map[string]interface{}
+		if err := yaml.Unmarshal(out, &got); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeUserDataMultipart(t *testing.T) {
+	inst := &Instance{Name: "vm", UserData: writeUserData(t, map[string]string{
+		"extra.cfg": "packages: [jq]\n",
+		"setup.sh":  "#!/bin/sh\necho setup\n",
+	})}
+	out, err := inst.mergeUserData([]byte("#cloud-config\npackages: [curl]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("got %s, want multipart/mixed", mediaType)
+	}
+	type part struct {
+		contentType string
+		filename    string
+		content     string
+	}
+	var parts []part
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts = append(parts, part{contentType, p.FileName(), string(content)})
+	}
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want the cloud-config and the script", len(parts))
+	}
+	if parts[0].contentType != "text/cloud-config" || parts[0].filename != "gokvm.cfg" {
+		t.Errorf("got first part %s %s, want the text/cloud-config gokvm.cfg", parts[0].contentType, parts[0].filename)
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal([]byte(parts[0].content), &config); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"curl", "jq"}; !reflect.DeepEqual(config["packages"], want) {
+		t.Errorf("got packages %v, want %v", config["packages"], want)
+	}
+	if !strings.HasPrefix(parts[0].content, cloudConfigHeader+"\n") {
+		t.Errorf("cloud-config part %q lacks the header", parts[0].content)
+	}
+	if parts[1].contentType != "text/x-shellscript" || parts[1].filename != "setup.sh" || parts[1].content != "#!/bin/sh\necho setup\n" {
+		t.Errorf("got second part %+v, want the script setup.sh", parts[1])
+	}
+}
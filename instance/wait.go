@@ -0,0 +1,159 @@
+package instance
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+	"github.com/michaelhenkel/gokvm/distro"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var pollInterval = 2 * time.Second
+
+// WaitReady blocks until the instance has an address, answers on the SSH
+// port and cloud-init finished, or fails once timeout is exceeded.
+// Instances provisioned by Ignition wait for systemd to finish booting
+// instead of cloud-init.
+func (i *Instance) WaitReady(l backend.Backend, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type stage struct {
+		name  string
+		ready func(context.Context, backend.Backend, *Instance) (bool, error)
+	}
+	stages := []stage{
+		{"address", hasAddress},
+		{"ssh", sshReachable},
+	}
+	if profile, err := distro.Lookup(i.Distro); err == nil && profile.Provisioner == distro.Ignition {
+		stages = append(stages, stage{"boot", systemBooted})
+	} else {
+		stages = append(stages, stage{"cloud-init", cloudInitDone})
+	}
+	for _, stage := range stages {
+		for {
+			inst, err := Get(l, i.Name, "")
+			if err != nil {
+				return err
+			}
+			if inst == nil {
+				return fmt.Errorf("instance %s not found", i.Name)
+			}
+			ready, err := stage.ready(ctx, l, inst)
+			if err != nil {
+				return err
+			}
+			if ready {
+				log.Infof("%s: %s ready", i.Name, stage.name)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("timed out after %s waiting for %s", timeout, stage.name)
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+	return nil
+}
+
+func hasAddress(ctx context.Context, l backend.Backend, inst *Instance) (bool, error) {
+	if inst.State != backend.DomainRunning {
+		return false, nil
+	}
+	_, err := inst.Address()
+	return err == nil, nil
+}
+
+func sshReachable(ctx context.Context, l backend.Backend, inst *Instance) (bool, error) {
+	addr, err := inst.Address()
+	if err != nil {
+		return false, nil
+	}
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(dialCtx, "tcp", net.JoinHostPort(addr, "22"))
+	if err != nil {
+		return false, nil
+	}
+	conn.Close()
+	return true, nil
+}
+
+// cloudInitDone asks cloud-init for its status. An error status fails
+// the wait right away.
+func cloudInitDone(ctx context.Context, l backend.Backend, inst *Instance) (bool, error) {
+	return cloudInitStatus(guestOutput(ctx, l, inst, []string{"cloud-init", "status"}))
+}
+
+// systemBooted reports whether systemd finished starting units, failed
+// units do not hold the wait.
+func systemBooted(ctx context.Context, l backend.Backend, inst *Instance) (bool, error) {
+	switch strings.TrimSpace(guestOutput(ctx, l, inst, []string{"systemctl", "is-system-running"})) {
+	case "running", "degraded":
+		return true, nil
+	}
+	return false, nil
+}
+
+// guestOutput runs command through the guest agent or, if the agent does
+// not answer, over SSH and returns its stdout. The exit code is ignored,
+// status commands exit non-zero while the guest is not ready.
+func guestOutput(ctx context.Context, l backend.Backend, inst *Instance, command []string) string {
+	execCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if result, err := inst.Exec(execCtx, l, command, nil); err == nil {
+		return string(result.Stdout)
+	}
+	args, err := inst.SSHArgs(command)
+	if err != nil {
+		return ""
+	}
+	args = append([]string{args[0], "-o", "BatchMode=yes", "-o", "ConnectTimeout=5"}, args[1:]...)
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &out
+	cmd.Run()
+	return out.String()
+}
+
+// cloudInitStatus parses the output of cloud-init status. Newer releases
+// report recoverable errors in an extended status like "degraded done"
+// next to the status line.
+func cloudInitStatus(out string) (bool, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	status := strings.TrimSpace(lines[0])
+	for _, line := range lines {
+		idx := strings.Index(line, ":")
+		if idx < 0 {
+			continue
+		}
+		fields := strings.Fields(line[idx+1:])
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.TrimSpace(line[:idx]) {
+		case "status":
+			status = fields[0]
+		case "extended_status":
+			// the extended status is the status prefixed by degraded
+			status = fields[len(fields)-1]
+		}
+	}
+	switch status {
+	case "done", "disabled":
+		return true, nil
+	case "error":
+		return false, fmt.Errorf("cloud-init failed")
+	}
+	return false, nil
+}
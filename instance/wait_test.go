@@ -0,0 +1,30 @@
+package instance
+
+import "testing"
+
+func TestCloudInitStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		ready   bool
+		wantErr bool
+	}{
+		{"done", "status: done\n", true, false},
+		{"bare done", "done", true, false},
+		{"disabled", "status: disabled\n", true, false},
+		{"running", "status: running\n", false, false},
+		{"progress dots", ".....\nstatus: done\n", true, false},
+		{"not started", "status: not started\n", false, false},
+		{"error", "status: error\n", false, true},
+		{"degraded done", "status: done\nextended_status: degraded done\nboot_status_code: enabled-by-generator\n", true, false},
+		{"degraded running", "status: running\nextended_status: degraded running\n", false, false},
+		{"degraded error", "status: error\nextended_status: degraded error\n", false, true},
+		{"no output", "", false, false},
+	}
+	for _, tt := range tests {
+		ready, err := cloudInitStatus(tt.out)
+		if ready != tt.ready || (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %t, %v, want %t and an error %t", tt.name, ready, err, tt.ready, tt.wantErr)
+		}
+	}
+}
@@ -11,6 +11,43 @@ type Metadata struct {
 	Image   *string  `xml:"image"`
 	Cluster *string  `xml:"cluster"`
 	Subnet  *string  `xml:"subnet"`
+	// State is the domain state a snapshot was taken of, when it differs
+	// from the state libvirt records.
+	State *string `xml:"state"`
+	// Instance is kept in its own namespace, libvirt stores only one
+	// metadata element per namespace.
+	Instance *Instance `xml:"instance"`
+	OSInfo   *OSInfo   `xml:"http://libosinfo.org/xmlns/libvirt/domain/1.0 libosinfo"`
+}
+
+// Instance holds what gokvm needs to reach an instance after creation.
+type Instance struct {
+	XMLName xml.Name `xml:"http://gokvm/instance instance"`
+	Role    string   `xml:"role,omitempty"`
+	User    string   `xml:"user,omitempty"`
+	SSHKey  string   `xml:"sshkey,omitempty"`
+	Distro  string   `xml:"distro,omitempty"`
+	// Addresses are the statically configured addresses.
+	Addresses []Address `xml:"address"`
+}
+
+type Address struct {
+	MAC string `xml:"mac,attr"`
+	IP  string `xml:"ip,attr"`
+}
+
+// OSInfo names the guest OS for libosinfo based tools like virt-manager.
+type OSInfo struct {
+	XMLName xml.Name `xml:"http://libosinfo.org/xmlns/libvirt/domain/1.0 libosinfo"`
+	OS      struct {
+		ID string `xml:"id,attr"`
+	} `xml:"http://libosinfo.org/xmlns/libvirt/domain/1.0 os"`
+}
+
+func NewOSInfo(id string) *OSInfo {
+	osInfo := &OSInfo{}
+	osInfo.OS.ID = id
+	return osInfo
 }
 
 func GetMetadata(metadata string) (*Metadata, error) {
@@ -40,6 +77,21 @@ func (m *Metadata) InstanceMetadata() string {
 	if m.Image != nil {
 		metadataString = metadataString + getXMLLine(m.Image, "image")
 	}
+	if m.State != nil {
+		metadataString = metadataString + getXMLLine(m.State, "state")
+	}
+	if m.Instance != nil {
+		instanceXML, err := xml.Marshal(m.Instance)
+		if err == nil {
+			metadataString = metadataString + string(instanceXML)
+		}
+	}
+	if m.OSInfo != nil {
+		osInfoXML, err := xml.Marshal(m.OSInfo)
+		if err == nil {
+			metadataString = metadataString + string(osInfoXML)
+		}
+	}
 	return metadataString
 
 }
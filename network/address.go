@@ -0,0 +1,153 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/michaelhenkel/gokvm/backend"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+)
+
+// Reservation is a DHCP host entry of the network.
+type Reservation struct {
+	MAC string
+	IP  net.IP
+}
+
+// DHCPRange is a range of addresses leased dynamically, both ends
+// included.
+type DHCPRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+// contains reports whether ip lies within the range.
+func (r DHCPRange) contains(ip net.IP) bool {
+	addr := ipToUint32(ip)
+	return addr >= ipToUint32(r.Start) && addr <= ipToUint32(r.End)
+}
+
+// AllocateIP returns a static address for name from the subnet. The
+// address is derived from a hash of name so that recreating an instance
+// yields the same address. If it is taken by the network itself, a
+// reservation, is in used or in a DHCP range, the next free address is
+// returned. Addresses in a DHCP range are only handed out once no other
+// is left, the DHCP host reservation of the instance keeps them from
+// being leased to anyone else.
+func (n *Network) AllocateIP(name string, used map[string]bool) (net.IP, error) {
+	if n.Subnet == nil {
+		return nil, fmt.Errorf("network %s has no subnet", n.Name)
+	}
+	base := n.Subnet.IP.Mask(n.Subnet.Mask).To4()
+	if base == nil {
+		return nil, fmt.Errorf("network %s: static addresses need an IPv4 subnet", n.Name)
+	}
+	ones, bits := n.Subnet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("network %s: subnet %s too small", n.Name, n.Subnet)
+	}
+	// network and broadcast address are left out
+	hosts := uint32(1)<<uint(bits-ones) - 2
+	taken := map[string]bool{
+		n.Gateway.String():   true,
+		n.DNSServer.String(): true,
+	}
+	for _, reservation := range n.Reservations {
+		taken[reservation.IP.String()] = true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	offset := h.Sum32() % hosts
+	for _, inRange := range []bool{false, true} {
+		for i := uint32(0); i < hosts; i++ {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(base)+1+(offset+i)%hosts)
+			if taken[ip.String()] || used[ip.String()] || n.inDHCPRange(ip) != inRange {
+				continue
+			}
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("network %s: no free address in %s", n.Name, n.Subnet)
+}
+
+func (n *Network) inDHCPRange(ip net.IP) bool {
+	for _, r := range n.DHCPRanges {
+		if r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	if ip = ip.To4(); ip == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+// Nameserver returns the DNS server of the network, the gateway if none
+// is configured.
+func (n *Network) Nameserver() net.IP {
+	if n.DNSServer != nil {
+		return n.DNSServer
+	}
+	return n.Gateway
+}
+
+// Reserve adds a DHCP host entry for mac and ip so that the address is not
+// leased to anyone else. Networks without DHCP are left alone.
+func (n *Network) Reserve(l backend.Backend, mac string, ip net.IP) error {
+	if !n.DHCP {
+		return nil
+	}
+	lnetwork, err := l.LookupNetwork(n.Name)
+	if err != nil {
+		return err
+	}
+	hostXML, err := dhcpHostXML(mac, ip)
+	if err != nil {
+		return err
+	}
+	if err := lnetwork.AddDHCPHost(hostXML); err != nil {
+		return fmt.Errorf("reserving %s for %s in network %s: %s", ip, mac, n.Name, err)
+	}
+	n.Reservations = append(n.Reservations, Reservation{MAC: mac, IP: ip})
+	return nil
+}
+
+// Release removes the DHCP host entries of mac.
+func (n *Network) Release(l backend.Backend, mac string) error {
+	var reservations []Reservation
+	for _, reservation := range n.Reservations {
+		if reservation.MAC != mac {
+			reservations = append(reservations, reservation)
+			continue
+		}
+		lnetwork, err := l.LookupNetwork(n.Name)
+		if err != nil {
+			return err
+		}
+		hostXML, err := dhcpHostXML(reservation.MAC, reservation.IP)
+		if err != nil {
+			return err
+		}
+		if err := lnetwork.DeleteDHCPHost(hostXML); err != nil {
+			return err
+		}
+	}
+	n.Reservations = reservations
+	return nil
+}
+
+func dhcpHostXML(mac string, ip net.IP) (string, error) {
+	host := libvirtxml.NetworkDHCPHost{
+		MAC: mac,
+		IP:  ip.String(),
+	}
+	return host.Marshal()
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllocateIP(t *testing.T) {
+	subnet := func(cidr string) *net.IPNet {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		return ipNet
+	}
+	// 192.168.1.0/29 has the hosts .1 to .6
+	small := Network{
+		Name:    "small",
+		Subnet:  subnet("192.168.1.0/29"),
+		Gateway: net.ParseIP("192.168.1.1"),
+	}
+	dhcpRange := func(start, end string) DHCPRange {
+		return DHCPRange{Start: net.ParseIP(start), End: net.ParseIP(end)}
+	}
+	withDHCP := small
+	withDHCP.DHCPRanges = []DHCPRange{dhcpRange("192.168.1.4", "192.168.1.6")}
+	withRanges := small
+	withRanges.DHCPRanges = []DHCPRange{dhcpRange("192.168.1.2", "192.168.1.2"), dhcpRange("192.168.1.4", "192.168.1.6")}
+	// the range networks created before static addresses used
+	wholeRange := small
+	wholeRange.DHCPRanges = []DHCPRange{dhcpRange("192.168.1.2", "192.168.1.6")}
+	withReservation := withDHCP
+	withReservation.Reservations = []Reservation{{MAC: "52:54:00:00:00:01", IP: net.ParseIP("192.168.1.2")}}
+
+	tests := []struct {
+		name    string
+		netw    Network
+		used    []string
+		allowed []string
+		wantErr bool
+	}{{
+		name:    "skips gateway",
+		netw:    small,
+		allowed: []string{"192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6"},
+	}, {
+		name:    "skips DHCP range",
+		netw:    withDHCP,
+		allowed: []string{"192.168.1.2", "192.168.1.3"},
+	}, {
+		name:    "skips all DHCP ranges",
+		netw:    withRanges,
+		allowed: []string{"192.168.1.3"},
+	}, {
+		name:    "DHCP range over the subnet",
+		netw:    wholeRange,
+		allowed: []string{"192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6"},
+	}, {
+		name:    "DHCP range once the rest is used",
+		netw:    withDHCP,
+		used:    []string{"192.168.1.2", "192.168.1.3"},
+		allowed: []string{"192.168.1.4", "192.168.1.5", "192.168.1.6"},
+	}, {
+		name:    "skips reservations",
+		netw:    withReservation,
+		allowed: []string{"192.168.1.3"},
+	}, {
+		name:    "skips used",
+		netw:    withDHCP,
+		used:    []string{"192.168.1.3"},
+		allowed: []string{"192.168.1.2"},
+	}, {
+		name:    "exhausted",
+		netw:    withReservation,
+		used:    []string{"192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6"},
+		wantErr: true,
+	}, {
+		name:    "no subnet",
+		netw:    Network{Name: "none"},
+		wantErr: true,
+	}, {
+		name:    "IPv6",
+		netw:    Network{Name: "v6", Subnet: subnet("fd00::/64")},
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := map[string]bool{}
+			for _, ip := range tt.used {
+				used[ip] = true
+			}
+			for _, name := range []string{"c-instance-0", "w-instance-0", "w-instance-1"} {
+				ip, err := tt.netw.AllocateIP(name, used)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatalf("%s: got %s, want an error", name, ip)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				if !contains(tt.allowed, ip.String()) {
+					t.Errorf("%s: got %s, want one of %v", name, ip, tt.allowed)
+				}
+				again, err := tt.netw.AllocateIP(name, used)
+				if err != nil || !again.Equal(ip) {
+					t.Errorf("%s: got %s and then %s, want the same address", name, ip, again)
+				}
+			}
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,16 +1,17 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/michaelhenkel/gokvm/backend"
 	"github.com/michaelhenkel/gokvm/metadata"
-	"github.com/michaelhenkel/gokvm/qemu"
 	"gopkg.in/yaml.v3"
 
-	libvirt "libvirt.org/libvirt-go"
 	libvirtxml "libvirt.org/libvirt-go-xml"
 )
 
@@ -38,30 +39,27 @@ func DefaultNetwork() Network {
 }
 
 type Network struct {
-	Name       string
-	Type       NetworkType
-	Subnet     *net.IPNet
-	Gateway    net.IP
-	DNSServer  net.IP
-	DHCP       bool
+	Name      string
+	Type      NetworkType
+	Subnet    *net.IPNet
+	Gateway   net.IP
+	DNSServer net.IP
+	DHCP      bool
+	// DHCPRanges hold the dynamically leased addresses, static addresses
+	// are allocated outside of them while possible.
+	DHCPRanges []DHCPRange
 	networkCFG libvirtxml.Network
 	Active     bool
 	Bridge     string
+	// Reservations are the DHCP host entries, static instance addresses
+	// are reserved there.
+	Reservations []Reservation
 }
 
-func (n *Network) Delete() error {
-	l, err := qemu.Connnect()
+func (n *Network) Delete(l backend.Backend) error {
+	networkCFG, err := l.LookupNetwork(n.Name)
 	if err != nil {
-		return err
-	}
-
-	networkCFG, err := l.LookupNetworkByName(n.Name)
-	if err != nil {
-		lerr, ok := err.(libvirt.Error)
-		if !ok {
-			return err
-		}
-		if lerr.Code == libvirt.ERR_NO_NETWORK {
+		if errors.Is(err, backend.ErrNotFound) {
 			return nil
 		}
 		return err
@@ -82,8 +80,8 @@ func (n *Network) Delete() error {
 	return nil
 }
 
-func Get(networkName string) (*Network, error) {
-	networks, err := List()
+func Get(l backend.Backend, networkName string) (*Network, error) {
+	networks, err := List(l)
 	if err != nil {
 		return nil, err
 	}
@@ -95,34 +93,14 @@ func Get(networkName string) (*Network, error) {
 	return nil, nil
 }
 
-func List() ([]*Network, error) {
-	conn, err := qemu.Connnect()
-	if err != nil {
-		return nil, err
-	}
+func List(conn backend.Backend) ([]*Network, error) {
 	networks := []*Network{}
 
-	activeNetworks, err := conn.ListAllNetworks(2)
-	if err != nil {
-		return nil, err
-	}
-	for _, anet := range activeNetworks {
-		if ok, err := checkMetadata(anet); err != nil {
-			return nil, err
-		} else if !ok {
-			continue
-		}
-		netw, err := lnetworkToNetwork(anet)
-		if err != nil {
-			return nil, err
-		}
-		networks = append(networks, netw)
-	}
-	inActiveNetworks, err := conn.ListAllNetworks(1)
+	allNetworks, err := conn.ListNetworks()
 	if err != nil {
 		return nil, err
 	}
-	for _, anet := range inActiveNetworks {
+	for _, anet := range allNetworks {
 		if ok, err := checkMetadata(anet); err != nil {
 			return nil, err
 		} else if !ok {
@@ -138,8 +116,8 @@ func List() ([]*Network, error) {
 	return networks, nil
 }
 
-func lnetworkToNetwork(lnetwork libvirt.Network) (*Network, error) {
-	networkName, err := lnetwork.GetName()
+func lnetworkToNetwork(lnetwork backend.Network) (*Network, error) {
+	networkName, err := lnetwork.Name()
 	if err != nil {
 		return nil, err
 	}
@@ -147,7 +125,7 @@ func lnetworkToNetwork(lnetwork libvirt.Network) (*Network, error) {
 	if err != nil {
 		return nil, err
 	}
-	networkXML, err := lnetwork.GetXMLDesc(0)
+	networkXML, err := lnetwork.XML()
 	if err != nil {
 		return nil, err
 	}
@@ -170,6 +148,18 @@ func lnetworkToNetwork(lnetwork libvirt.Network) (*Network, error) {
 		netw.Gateway = ip
 		if netwIP.DHCP != nil {
 			netw.DHCP = true
+			for _, dhcpRange := range netwIP.DHCP.Ranges {
+				netw.DHCPRanges = append(netw.DHCPRanges, DHCPRange{
+					Start: net.ParseIP(dhcpRange.Start),
+					End:   net.ParseIP(dhcpRange.End),
+				})
+			}
+			for _, host := range netwIP.DHCP.Hosts {
+				netw.Reservations = append(netw.Reservations, Reservation{
+					MAC: strings.ToLower(host.MAC),
+					IP:  net.ParseIP(host.IP),
+				})
+			}
 		}
 	}
 	if xmlNetwork.DNS != nil {
@@ -197,8 +187,8 @@ func Render(networks []*Network) {
 	t.Render()
 }
 
-func checkMetadata(lnet libvirt.Network) (bool, error) {
-	xmlDesc, err := lnet.GetXMLDesc(0)
+func checkMetadata(lnet backend.Network) (bool, error) {
+	xmlDesc, err := lnet.XML()
 	if err != nil {
 		return false, err
 	}
@@ -222,13 +212,8 @@ func checkMetadata(lnet libvirt.Network) (bool, error) {
 	return false, nil
 }
 
-func (n *Network) Create() error {
-	conn, err := qemu.Connnect()
-	if err != nil {
-		return err
-	}
-
-	_, err = conn.LookupNetworkByName(n.Name)
+func (n *Network) Create(conn backend.Backend) error {
+	_, err := conn.LookupNetwork(n.Name)
 	if err == nil {
 		return nil
 	}
@@ -269,9 +254,14 @@ func (n *Network) Create() error {
 			for ip := n.Subnet.IP.Mask(n.Subnet.Mask); n.Subnet.Contains(ip); inc(ip) {
 				ips = append(ips, ip.String())
 			}
+			// the lower half of the subnet is left for static addresses
+			start := len(ips) / 2
+			if start < 2 {
+				start = 2
+			}
 			networkIPS[0].DHCP = &libvirtxml.NetworkDHCP{
 				Ranges: []libvirtxml.NetworkDHCPRange{{
-					Start: ips[2],
+					Start: ips[start],
 					End:   ips[len(ips)-2],
 				}},
 			}
@@ -284,7 +274,7 @@ func (n *Network) Create() error {
 	if err != nil {
 		return err
 	}
-	libvirtNet, err := conn.NetworkDefineXML(networkXML)
+	libvirtNet, err := conn.DefineNetwork(networkXML)
 	if err != nil {
 		return err
 	}
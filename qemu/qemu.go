@@ -1,14 +1,468 @@
 package qemu
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/michaelhenkel/gokvm/backend"
+
 	libvirt "libvirt.org/libvirt-go"
 )
 
-func Connnect() (*libvirt.Connect, error) {
-	conn, err := libvirt.NewConnect("qemu:///system")
+const DefaultURI = "qemu:///system"
+
+// Connect opens a libvirt connection to uri and returns it as a backend.
+func Connect(uri string) (backend.Backend, error) {
+	if uri == "" {
+		uri = DefaultURI
+	}
+	conn, err := libvirt.NewConnect(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &connection{conn: conn}, nil
+
+}
+
+type connection struct {
+	conn *libvirt.Connect
+}
+
+func (c *connection) Close() error {
+	_, err := c.conn.Close()
+	return err
+}
+
+func (c *connection) URI() (string, error) {
+	return c.conn.GetURI()
+}
+
+func (c *connection) Capabilities() (string, error) {
+	return c.conn.GetCapabilities()
+}
+
+func (c *connection) DomainCapabilities(emulator, arch, machine, virtType string) (string, error) {
+	return c.conn.GetDomainCapabilities(emulator, arch, machine, virtType, 0)
+}
+
+func (c *connection) ListDomains() ([]backend.Domain, error) {
+	ldomains, err := c.conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	var domains []backend.Domain
+	for idx := range ldomains {
+		domains = append(domains, &domain{conn: c.conn, dom: &ldomains[idx]})
+	}
+	return domains, nil
+}
+
+func (c *connection) LookupDomain(name string) (backend.Domain, error) {
+	ldom, err := c.conn.LookupDomainByName(name)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &domain{conn: c.conn, dom: ldom}, nil
+}
+
+func (c *connection) DefineDomain(xml string) (backend.Domain, error) {
+	ldom, err := c.conn.DomainDefineXML(xml)
+	if err != nil {
+		return nil, err
+	}
+	return &domain{conn: c.conn, dom: ldom}, nil
+}
+
+func (c *connection) ListNetworks() ([]backend.Network, error) {
+	lnetworks, err := c.conn.ListAllNetworks(0)
+	if err != nil {
+		return nil, err
+	}
+	var networks []backend.Network
+	for idx := range lnetworks {
+		networks = append(networks, &network{net: &lnetworks[idx]})
+	}
+	return networks, nil
+}
+
+func (c *connection) LookupNetwork(name string) (backend.Network, error) {
+	lnet, err := c.conn.LookupNetworkByName(name)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &network{net: lnet}, nil
+}
+
+func (c *connection) DefineNetwork(xml string) (backend.Network, error) {
+	lnet, err := c.conn.NetworkDefineXML(xml)
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	return &network{net: lnet}, nil
+}
 
+func (c *connection) LookupStoragePool(name string) (backend.StoragePool, error) {
+	lpool, err := c.conn.LookupStoragePoolByName(name)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &storagePool{conn: c.conn, pool: lpool}, nil
+}
+
+func (c *connection) DefineStoragePool(xml string) (backend.StoragePool, error) {
+	lpool, err := c.conn.StoragePoolDefineXML(xml, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &storagePool{conn: c.conn, pool: lpool}, nil
+}
+
+type domain struct {
+	conn *libvirt.Connect
+	dom  *libvirt.Domain
+}
+
+func (d *domain) Name() (string, error) {
+	return d.dom.GetName()
+}
+
+func (d *domain) XML() (string, error) {
+	return d.dom.GetXMLDesc(0)
+}
+
+func (d *domain) IsActive() (bool, error) {
+	return d.dom.IsActive()
+}
+
+func (d *domain) State() (backend.DomainState, error) {
+	state, _, err := d.dom.GetState()
+	if err != nil {
+		return "", err
+	}
+	switch state {
+	case libvirt.DOMAIN_RUNNING:
+		return backend.DomainRunning, nil
+	case libvirt.DOMAIN_BLOCKED:
+		return backend.DomainBlocked, nil
+	case libvirt.DOMAIN_PAUSED:
+		return backend.DomainPaused, nil
+	case libvirt.DOMAIN_SHUTDOWN:
+		return backend.DomainShutdown, nil
+	case libvirt.DOMAIN_SHUTOFF:
+		return backend.DomainShutoff, nil
+	case libvirt.DOMAIN_CRASHED:
+		return backend.DomainCrashed, nil
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return backend.DomainPMSuspended, nil
+	}
+	return backend.DomainNoState, nil
+}
+
+func (d *domain) Create() error {
+	return d.dom.Create()
+}
+
+func (d *domain) Shutdown() error {
+	return d.dom.Shutdown()
+}
+
+func (d *domain) Destroy() error {
+	return d.dom.Destroy()
+}
+
+func (d *domain) Reboot() error {
+	return d.dom.Reboot(libvirt.DOMAIN_REBOOT_DEFAULT)
+}
+
+func (d *domain) Suspend() error {
+	return d.dom.Suspend()
+}
+
+func (d *domain) Resume() error {
+	return d.dom.Resume()
+}
+
+func (d *domain) Undefine() error {
+	return d.dom.Undefine()
+}
+
+func (d *domain) SetAutostart(autostart bool) error {
+	return d.dom.SetAutostart(autostart)
+}
+
+func (d *domain) InterfaceAddresses(source backend.AddressSource) ([]backend.Interface, error) {
+	src := libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE
+	if source == backend.AddressesFromAgent {
+		src = libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT
+	}
+	intfList, err := d.dom.ListAllInterfaceAddresses(src)
+	if err != nil {
+		return nil, err
+	}
+	var interfaces []backend.Interface
+	for _, intf := range intfList {
+		i := backend.Interface{
+			Name:   intf.Name,
+			Hwaddr: intf.Hwaddr,
+		}
+		for _, addr := range intf.Addrs {
+			i.Addrs = append(i.Addrs, addr.Addr)
+		}
+		interfaces = append(interfaces, i)
+	}
+	return interfaces, nil
+}
+
+func (d *domain) AgentCommand(command string, timeout time.Duration) (string, error) {
+	seconds := libvirt.DomainQemuAgentCommandTimeout(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return d.dom.QemuAgentCommand(command, seconds, 0)
+}
+
+func (d *domain) CreateSnapshot(xml string) (backend.Snapshot, error) {
+	lsnap, err := d.dom.CreateSnapshotXML(xml, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{snap: lsnap}, nil
+}
+
+func (d *domain) ListSnapshots() ([]backend.Snapshot, error) {
+	lsnaps, err := d.dom.ListAllSnapshots(0)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []backend.Snapshot
+	for idx := range lsnaps {
+		snapshots = append(snapshots, &snapshot{snap: &lsnaps[idx]})
+	}
+	return snapshots, nil
+}
+
+func (d *domain) LookupSnapshot(name string) (backend.Snapshot, error) {
+	lsnap, err := d.dom.SnapshotLookupByName(name, 0)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &snapshot{snap: lsnap}, nil
+}
+
+type snapshot struct {
+	snap *libvirt.DomainSnapshot
+}
+
+func (s *snapshot) Name() (string, error) {
+	return s.snap.GetName()
+}
+
+func (s *snapshot) XML() (string, error) {
+	return s.snap.GetXMLDesc(0)
+}
+
+func (s *snapshot) Revert(running bool) error {
+	var flags libvirt.DomainSnapshotRevertFlags
+	if running {
+		flags = libvirt.DOMAIN_SNAPSHOT_REVERT_RUNNING
+	}
+	return s.snap.RevertToSnapshot(flags)
+}
+
+func (s *snapshot) Delete() error {
+	return s.snap.Delete(0)
+}
+
+type network struct {
+	net *libvirt.Network
+}
+
+func (n *network) Name() (string, error) {
+	return n.net.GetName()
+}
+
+func (n *network) XML() (string, error) {
+	return n.net.GetXMLDesc(0)
+}
+
+func (n *network) IsActive() (bool, error) {
+	return n.net.IsActive()
+}
+
+func (n *network) Create() error {
+	return n.net.Create()
+}
+
+func (n *network) Destroy() error {
+	return n.net.Destroy()
+}
+
+func (n *network) Undefine() error {
+	return n.net.Undefine()
+}
+
+func (n *network) SetAutostart(autostart bool) error {
+	return n.net.SetAutostart(autostart)
+}
+
+func (n *network) AddDHCPHost(xml string) error {
+	return n.updateDHCPHost(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, xml)
+}
+
+func (n *network) DeleteDHCPHost(xml string) error {
+	return n.updateDHCPHost(libvirt.NETWORK_UPDATE_COMMAND_DELETE, xml)
+}
+
+// updateDHCPHost changes the persistent config and, if the network
+// runs, the live one.
+func (n *network) updateDHCPHost(cmd libvirt.NetworkUpdateCommand, xml string) error {
+	flags := libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+	active, err := n.net.IsActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		flags |= libvirt.NETWORK_UPDATE_AFFECT_LIVE
+	}
+	return n.net.Update(cmd, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, xml, flags)
+}
+
+type storagePool struct {
+	conn *libvirt.Connect
+	pool *libvirt.StoragePool
+}
+
+func (p *storagePool) XML() (string, error) {
+	return p.pool.GetXMLDesc(0)
+}
+
+func (p *storagePool) Create() error {
+	return p.pool.Create(libvirt.STORAGE_POOL_CREATE_WITH_BUILD)
+}
+
+func (p *storagePool) Destroy() error {
+	return p.pool.Destroy()
+}
+
+func (p *storagePool) Undefine() error {
+	return p.pool.Undefine()
+}
+
+func (p *storagePool) SetAutostart(autostart bool) error {
+	return p.pool.SetAutostart(autostart)
+}
+
+func (p *storagePool) ListVolumes() ([]backend.StorageVolume, error) {
+	lvols, err := p.pool.ListAllStorageVolumes(0)
+	if err != nil {
+		return nil, err
+	}
+	var vols []backend.StorageVolume
+	for idx := range lvols {
+		vols = append(vols, &storageVolume{conn: p.conn, vol: &lvols[idx]})
+	}
+	return vols, nil
+}
+
+func (p *storagePool) LookupVolume(name string) (backend.StorageVolume, error) {
+	lvol, err := p.pool.LookupStorageVolByName(name)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return &storageVolume{conn: p.conn, vol: lvol}, nil
+}
+
+func (p *storagePool) CreateVolume(xml string) (backend.StorageVolume, error) {
+	lvol, err := p.pool.StorageVolCreateXML(xml, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &storageVolume{conn: p.conn, vol: lvol}, nil
+}
+
+func (d *domain) OpenConsole(force bool) (io.ReadWriteCloser, error) {
+	stream, err := d.conn.NewStream(0)
+	if err != nil {
+		return nil, err
+	}
+	var flags libvirt.DomainConsoleFlags
+	if force {
+		flags = libvirt.DOMAIN_CONSOLE_FORCE
+	}
+	if err := d.dom.OpenConsole("", stream, flags); err != nil {
+		stream.Free()
+		return nil, err
+	}
+	return &consoleStream{stream: stream}, nil
+}
+
+// consoleStream adapts a libvirt stream to io.ReadWriteCloser.
+type consoleStream struct {
+	stream *libvirt.Stream
+}
+
+func (s *consoleStream) Read(p []byte) (int, error) {
+	n, err := s.stream.Recv(p)
+	if err == nil && n == 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (s *consoleStream) Write(p []byte) (int, error) {
+	return s.stream.Send(p)
+}
+
+func (s *consoleStream) Close() error {
+	s.stream.Abort()
+	return s.stream.Free()
+}
+
+type storageVolume struct {
+	conn *libvirt.Connect
+	vol  *libvirt.StorageVol
+}
+
+func (v *storageVolume) XML() (string, error) {
+	return v.vol.GetXMLDesc(0)
+}
+
+func (v *storageVolume) Delete() error {
+	return v.vol.Delete(0)
+}
+
+func (v *storageVolume) Upload(r io.Reader, size uint64) error {
+	stream, err := v.conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	if err := v.vol.Upload(stream, 0, size, 0); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	return stream.SendAll(func(stream *libvirt.Stream, i int) ([]byte, error) {
+		return readNBytes(br, int64(i))
+	})
+}
+
+func readNBytes(r *bufio.Reader, peek int64) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(r, peek))
+}
+
+// wrapError maps libvirt's "no such object" errors to backend.ErrNotFound.
+func wrapError(err error) error {
+	lerr, ok := err.(libvirt.Error)
+	if !ok {
+		return err
+	}
+	switch lerr.Code {
+	case libvirt.ERR_NO_DOMAIN, libvirt.ERR_NO_NETWORK, libvirt.ERR_NO_STORAGE_POOL, libvirt.ERR_NO_STORAGE_VOL, libvirt.ERR_NO_DOMAIN_SNAPSHOT:
+		return fmt.Errorf("%w: %s", backend.ErrNotFound, lerr.Message)
+	}
+	return err
 }